@@ -0,0 +1,61 @@
+package archive
+
+import (
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+)
+
+type Track string
+const (
+    TrackAudio Track = "audio"
+    TrackVideo Track = "video"
+)
+
+// Something that happened while running a job. One of the types below.
+type Event interface {
+    event()
+}
+
+// A segment was downloaded, or found on disk from a previous run.
+type SegmentDone struct {
+    Track   Track
+    Segment int
+    Cached  bool
+}
+
+// A segment couldn't be downloaded and was given up on.
+type SegmentLost struct {
+    Track   Track
+    Segment int
+}
+
+// A segment failed and will be retried later.
+type SegmentRequeued struct {
+    Track   Track
+    Segment int
+}
+
+// All segments of a track were downloaded or lost.
+type DownloadFinished struct {
+    Track  Track
+    Result *download.DownloadResult
+}
+
+// Segments merged so far, and the segment count of each track.
+type MergeProgress struct {
+    Audio int
+    Video int
+    Total int
+}
+
+// The output file was written, or muxing failed.
+type MuxFinished struct {
+    Output string
+    Error  error
+}
+
+func (SegmentDone) event()      {}
+func (SegmentLost) event()      {}
+func (SegmentRequeued) event()  {}
+func (DownloadFinished) event() {}
+func (MergeProgress) event()    {}
+func (MuxFinished) event()      {}
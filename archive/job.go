@@ -0,0 +1,635 @@
+// Downloads and muxes a video, for embedding ytarchive-raw-go into other
+// programs. The command line tool is a thin wrapper around this package.
+package archive
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/merge"
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+var (
+    jobsMetric = metrics.NewCounter(
+        "ytarchive_jobs_total",
+        "Finished jobs, by result (ok, failed or stopped).",
+        "result",
+    )
+    runningJobsMetric = metrics.NewGauge(
+        "ytarchive_jobs_running",
+        "Jobs currently downloading or muxing.",
+    )
+)
+
+type Options struct {
+    // adjust how many threads work at once between MinThreads and
+    // MaxThreads, starting at Threads, depending on how often the server
+    // throttles requests. see download.DownloadTask
+    AdaptiveThreads bool
+    // client used for downloading, one using HTTP/3 is created if nil
+    Client          *util.HttpClient
+    // delete segments as soon as they're merged instead of once muxing is
+    // done, so a stopped job has to download them again
+    DisableResume   bool
+    // where to stop in the video, 0 for the end. see StartTime
+    EndTime         time.Duration
+    FailThreshold   uint
+    Fsync           bool
+    GapPolicy       merge.GapPolicy
+    // don't delete temporary files
+    KeepFiles       bool
+    // keep downloading new segments until the stream ends
+    Live            bool
+    LiveTimeout     time.Duration
+    // logger for messages not specific to a track, the default one if nil.
+    // if set, the loggers of the tracks and muxer are derived from it
+    Logger          *log.Logger
+    // highest thread count with AdaptiveThreads, raised to Threads if lower
+    MaxThreads      uint
+    // see download.DownloadTask.MergeWindow
+    MergeWindow     uint
+    // which merger to use, see merge.CreateBestMuxer
+    Merger          string
+    MergerArguments map[string]map[string]string
+    // lowest thread count with AdaptiveThreads, at least 1 and lowered to
+    // Threads if higher
+    MinThreads      uint
+    // called for every event, from multiple goroutines. must not block
+    // for long. may be nil
+    OnEvent         func(Event)
+    OnlyAudio       bool
+    OnlyVideo       bool
+    // output path without extension, can contain template keys such as
+    // %(id)s
+    Output          string
+    OverwriteTemp   bool
+    // itags to use, in order of preference. the best known format is used
+    // if nil
+    PreferredAudio  []int
+    PreferredVideo  []int
+    QueueMode       segments.QueueMode
+    // shared by the downloads using it to limit their combined throughput,
+    // such as the tracks of every job. may be nil
+    RateLimiter     *util.RateLimiter
+    RequeueDelay    time.Duration
+    RequeueFailed   uint
+    RequeueLast     bool
+    RetryThreshold  uint
+    SegmentCount    uint
+    SkipValidation  bool
+    StartSegment    uint
+    // where to start in the video. StartTime and EndTime are mapped to
+    // segments using the segment duration the server reports, replacing
+    // StartSegment and SegmentCount, and the output is trimmed to them
+    StartTime       time.Duration
+    // bytes per second for each track, 0 for no limit
+    TaskRateLimit   int64
+    // limits the space segments take in TempDir, shared by the jobs using
+    // it. segments are deleted once merged, and downloads use
+    // segments.QueueMergeAware. may be nil
+    TempBudget      *util.DiskBudget
+    // where to store segments and other temporary files. a new directory is
+    // created (and deleted once done) if empty
+    TempDir         string
+    Threads         uint
+}
+
+type Result struct {
+    // path of the muxed file
+    Output  string
+    // where segments and resume state are stored, needed to resume a
+    // cancelled job if Options.TempDir was empty
+    TempDir string
+    // nil for tracks that weren't downloaded
+    Audio   *download.DownloadResult
+    Video   *download.DownloadResult
+}
+
+// Progress of a running job
+type Status struct {
+    Audio download.ProgressStats
+    Video download.ProgressStats
+    Merge MergeProgress
+}
+
+// A single video download. Jobs can only be run once.
+type Job struct {
+    fregData *util.FregJson
+    opts     Options
+    mu       sync.Mutex
+    merged   MergeProgress
+    progress *download.TotalProgress
+    started  bool
+    tasks    map[Track]*download.DownloadTask
+}
+
+func NewJob(fregData *util.FregJson, opts Options) *Job {
+    return &Job {
+        fregData: fregData,
+        opts:     opts,
+        tasks:    make(map[Track]*download.DownloadTask),
+    }
+}
+
+func (j *Job) logger() *log.Logger {
+    if j.opts.Logger != nil {
+        return j.opts.Logger
+    }
+    return log.DefaultLogger
+}
+
+func (j *Job) subLogger(tag string) *log.Logger {
+    if j.opts.Logger != nil {
+        return j.opts.Logger.SubLogger(tag)
+    }
+    return log.New(tag)
+}
+
+func (j *Job) emit(e Event) {
+    if j.opts.OnEvent != nil {
+        j.opts.OnEvent(e)
+    }
+}
+
+// picks the format used by a previous run if possible, so already downloaded
+// segments can be reused
+func (j *Job) bestUrl(journal *download.Journal, which Track, urls map[int]string, preferred []int, best func([]int) (string, error)) (string, error) {
+    if preferred == nil {
+        if itag, ok := journal.Itag(string(which)); ok {
+            if url, ok := urls[itag]; ok {
+                j.logger().Infof("Using format %d for %s from previous run", itag, which)
+                return url, nil
+            }
+        }
+    }
+    return best(preferred)
+}
+
+func (j *Job) createTask(ctx context.Context, client *util.HttpClient, which Track, url string, m merge.Merger, progress *download.Progress, journal *download.Journal, tempDir string) *download.DownloadTask {
+    return &download.DownloadTask {
+        AdaptiveThreads: j.opts.AdaptiveThreads,
+        Client:         client,
+        Context:        ctx,
+        FailThreshold:  j.opts.FailThreshold,
+        Fsync:          j.opts.Fsync,
+        Journal:        journal.Track(string(which)),
+        Live:           j.opts.Live,
+        LiveTimeout:    j.opts.LiveTimeout,
+        Logger:         j.subLogger("download." + string(which)),
+        MaxThreads:     j.opts.MaxThreads,
+        MergeWindow:    j.opts.MergeWindow,
+        Merger:         m,
+        MinThreads:     j.opts.MinThreads,
+        OnSegment:      func(segment int, event download.SegmentEvent) {
+            switch event {
+            case download.SegmentDone, download.SegmentCached:
+                j.emit(SegmentDone {
+                    Track:   which,
+                    Segment: segment,
+                    Cached:  event == download.SegmentCached,
+                })
+            case download.SegmentLost:
+                j.emit(SegmentLost { Track: which, Segment: segment })
+            case download.SegmentRequeued:
+                j.emit(SegmentRequeued { Track: which, Segment: segment })
+            }
+        },
+        Progress:       progress,
+        QueueMode:      j.opts.QueueMode,
+        RateLimiter:    j.opts.RateLimiter,
+        RequeueDelay:   j.opts.RequeueDelay,
+        RequeueFailed:  j.opts.RequeueFailed,
+        RequeueLast:    j.opts.RequeueLast,
+        RetryThreshold: j.opts.RetryThreshold,
+        SegmentCount:   j.opts.SegmentCount,
+        SegmentDir:     tempDir,
+        SkipValidation: j.opts.SkipValidation,
+        StartSegment:   j.opts.StartSegment,
+        TaskRateLimit:  j.opts.TaskRateLimit,
+        TempBudget:     j.opts.TempBudget,
+        Threads:        j.opts.Threads,
+        Track:          string(which),
+        Url:            url,
+    }
+}
+
+// sets the segments to download from the start and end times, returning
+// where to trim the output relative to the first downloaded segment
+func (j *Job) mapClip(ctx context.Context, client *util.HttpClient) (time.Duration, time.Duration, error) {
+    if j.opts.Live {
+        return 0, 0, fmt.Errorf("Clipping by time isn't supported for live streams")
+    }
+    if j.opts.EndTime > 0 && j.opts.EndTime <= j.opts.StartTime {
+        return 0, 0, fmt.Errorf("End time must be after start time")
+    }
+    //every format of a video has the same segment duration
+    best := j.fregData.BestVideo
+    preferred := j.opts.PreferredVideo
+    if j.opts.OnlyAudio {
+        best = j.fregData.BestAudio
+        preferred = j.opts.PreferredAudio
+    }
+    url, err := best(preferred)
+    if err != nil {
+        return 0, 0, err
+    }
+    info, err := download.ProbeStream(ctx, client, url)
+    if err != nil {
+        return 0, 0, fmt.Errorf("Unable to get segment duration: %v", err)
+    }
+    duration := info.SegmentDuration()
+    if duration <= 0 {
+        return 0, 0, fmt.Errorf("Unable to get segment duration, the server didn't send the stream length")
+    }
+
+    start := int(j.opts.StartTime / duration)
+    end := info.HeadSeqnum
+    if j.opts.EndTime > 0 {
+        if e := int((j.opts.EndTime + duration - 1) / duration); e < end {
+            end = e
+        }
+    }
+    if start >= end {
+        return 0, 0, fmt.Errorf("Start time %v is past the end of the video (%v)", j.opts.StartTime, info.HeadTime)
+    }
+    j.opts.StartSegment = uint(start)
+    j.opts.SegmentCount = uint(end - start)
+    j.logger().Infof("Segments are %v long, downloading segments %d to %d", duration, start, end - 1)
+
+    offset := time.Duration(start) * duration
+    clipStart := j.opts.StartTime - offset
+    var clipEnd time.Duration
+    if j.opts.EndTime > 0 {
+        clipEnd = j.opts.EndTime - offset
+    }
+    return clipStart, clipEnd, nil
+}
+
+// the concat merger copies every segment into one file per track before
+// muxing, which has to fit in the temp size limit. estimated from the size
+// of the first segment of each track
+func (j *Job) checkConcatSpace(ctx context.Context, client *util.HttpClient) error {
+    type track struct {
+        skip      bool
+        preferred []int
+        best      func([]int) (string, error)
+    }
+    tracks := []track {
+        { skip: j.opts.OnlyVideo, preferred: j.opts.PreferredAudio, best: j.fregData.BestAudio },
+        { skip: j.opts.OnlyAudio, preferred: j.opts.PreferredVideo, best: j.fregData.BestVideo },
+    }
+    var needed int64
+    for _, t := range tracks {
+        if t.skip {
+            continue
+        }
+        url, err := t.best(t.preferred)
+        if err != nil {
+            return err
+        }
+        info, err := download.ProbeStream(ctx, client, url)
+        if err != nil {
+            return fmt.Errorf("Unable to estimate the stream size: %v", err)
+        }
+        if info.FirstSegmentSize <= 0 {
+            j.logger().Warn("Unable to estimate the stream size, the concat merger might not fit in the temp size limit")
+            return nil
+        }
+        count := int64(j.opts.SegmentCount)
+        if count == 0 {
+            count = int64(info.HeadSeqnum) - int64(j.opts.StartSegment)
+        }
+        needed += count * info.FirstSegmentSize
+    }
+
+    if limit := j.opts.TempBudget.Limit(); needed > limit {
+        return fmt.Errorf(
+            "The concat merger needs about %s of temporary space to copy the segments, more than the limit of %s. Use the tcp or native merger instead",
+            util.FormatByteSize(float64(needed)),
+            util.FormatByteSize(float64(limit)),
+        )
+    }
+    return nil
+}
+
+// Downloads and muxes the video. Returns once muxing is done, or once ctx
+// is cancelled and the downloads and muxer have stopped, with ctx.Err() as
+// the error. Segments and resume state are
+// kept on errors, so running a new job with the same temporary directory
+// continues where this one stopped.
+func (j *Job) Run(ctx context.Context) (*Result, error) {
+    j.mu.Lock()
+    if j.started {
+        j.mu.Unlock()
+        return nil, fmt.Errorf("Job has already been run")
+    }
+    j.started = true
+    j.mu.Unlock()
+
+    runningJobsMetric.Add(1)
+    defer runningJobsMetric.Add(-1)
+
+    res, err := j.run(ctx)
+    switch {
+    case err == nil:
+        jobsMetric.Inc("ok")
+    case err == context.Canceled:
+        jobsMetric.Inc("stopped")
+    default:
+        jobsMetric.Inc("failed")
+    }
+    return res, err
+}
+
+func (j *Job) run(ctx context.Context) (*Result, error) {
+    if j.opts.OnlyAudio && j.opts.OnlyVideo {
+        return nil, fmt.Errorf("Can't download only audio and only video at the same time")
+    }
+
+    id := j.fregData.Metadata.Id
+    output, err := j.fregData.FormatTemplate(j.opts.Output, true)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid output template: %v", err)
+    }
+    j.logger().Infof("Saving output to %s", output)
+
+    tempDir := j.opts.TempDir
+    deleteTempDir := false
+    if tempDir == "" {
+        tempDir, err = ioutil.TempDir("", fmt.Sprintf("ytarchive-%s-", id))
+        if err != nil {
+            return nil, fmt.Errorf("Unable to create temp dir: %v", err)
+        }
+        j.logger().Infof("Storing temporary files in %s", tempDir)
+        deleteTempDir = !j.opts.KeepFiles
+    } else {
+        if err = os.MkdirAll(tempDir, 0755); err != nil {
+            return nil, fmt.Errorf("Unable to create temp dir at '%s': %v", tempDir, err)
+        }
+    }
+
+    unlockTemp, err := util.TryLockFile(filepath.Join(tempDir, id + ".lock"))
+    if err == util.ErrLocked {
+        return nil, fmt.Errorf("This video is already being downloaded by another instance with the same temporary directory")
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer unlockTemp()
+
+    //also stops the other track if one can't be started
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    client := j.opts.Client
+    if client == nil {
+        client = util.NewClient(&util.HttpClientConfig {
+            UseQuic: true,
+        })
+    }
+
+    //only the segment the merger waits for can be downloaded once the
+    //budget is used up, which the other modes don't know about
+    if j.opts.TempBudget != nil && j.opts.QueueMode != segments.QueueMergeAware {
+        j.logger().Info("Using merge-aware queue mode to stay within the temp size limit")
+        j.opts.QueueMode = segments.QueueMergeAware
+    }
+
+    var clipStart, clipEnd time.Duration
+    if j.opts.StartTime > 0 || j.opts.EndTime > 0 {
+        clipStart, clipEnd, err = j.mapClip(ctx, client)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    muxer, err := merge.CreateBestMuxer(&merge.MuxerOptions {
+        ClipEnd:         clipEnd,
+        ClipStart:       clipStart,
+        Context:         ctx,
+        DeleteSegments:  !j.opts.KeepFiles,
+        DisableResume:   j.opts.DisableResume,
+        FinalFileBase:   output,
+        FregData:        j.fregData,
+        GapPolicy:       j.opts.GapPolicy,
+        // this looks wrong but is correct
+        IgnoreAudio:     j.opts.OnlyVideo,
+        IgnoreVideo:     j.opts.OnlyAudio,
+        Logger:          j.subLogger("muxer"),
+        Merger:          j.opts.Merger,
+        MergerArguments: j.opts.MergerArguments,
+        OnProgress:      func(audio, video, total int) {
+            merged := MergeProgress { Audio: audio, Video: video, Total: total }
+            j.mu.Lock()
+            j.merged = merged
+            j.mu.Unlock()
+            j.emit(merged)
+        },
+        OverwriteTemp:   j.opts.OverwriteTemp,
+        TempBudget:      j.opts.TempBudget,
+        TempDir:         tempDir,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("Unable to create muxer: %v", err)
+    }
+
+    if _, ok := muxer.(*merge.ConcatMuxer); ok && j.opts.TempBudget != nil {
+        if err = j.checkConcatSpace(ctx, client); err != nil {
+            return nil, err
+        }
+    }
+
+    if err = os.MkdirAll(filepath.Dir(muxer.OutputFilePath()), 0755); err != nil {
+        return nil, fmt.Errorf("Unable to create parent directories for output file: %v", err)
+    }
+
+    unlockOutput, err := util.TryLockFile(muxer.OutputFilePath() + ".lock")
+    if err == util.ErrLocked {
+        return nil, fmt.Errorf("Another instance is already writing to this output file")
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer unlockOutput()
+
+    journal, err := download.OpenJournal(filepath.Join(tempDir, id + ".state.json"), id)
+    if err != nil {
+        j.logger().Warnf("Not resuming from previous state: %v", err)
+    }
+    defer journal.Close()
+
+    progress := download.NewProgress()
+    j.mu.Lock()
+    j.progress = progress
+    j.mu.Unlock()
+    result := &Result {
+        Output:  muxer.OutputFilePath(),
+        TempDir: tempDir,
+    }
+
+    type track struct {
+        which     Track
+        skip      bool
+        urls      map[int]string
+        preferred []int
+        best      func([]int) (string, error)
+        merger    merge.Merger
+        progress  *download.Progress
+        result    **download.DownloadResult
+    }
+    tracks := []track {
+        {
+            which:     TrackAudio,
+            skip:      j.opts.OnlyVideo,
+            urls:      j.fregData.Audio,
+            preferred: j.opts.PreferredAudio,
+            best:      j.fregData.BestAudio,
+            merger:    muxer.AudioMerger(),
+            progress:  progress.Audio(),
+            result:    &result.Audio,
+        },
+        {
+            which:     TrackVideo,
+            skip:      j.opts.OnlyAudio,
+            urls:      j.fregData.Video,
+            preferred: j.opts.PreferredVideo,
+            best:      j.fregData.BestVideo,
+            merger:    muxer.VideoMerger(),
+            progress:  progress.Video(),
+            result:    &result.Video,
+        },
+    }
+
+    var startErr error
+    tasks := make([]*download.DownloadTask, len(tracks))
+    for i, t := range tracks {
+        if t.skip || startErr != nil {
+            merge.MergeNothing(t.merger)
+            continue
+        }
+        url, err := j.bestUrl(journal, t.which, t.urls, t.preferred, t.best)
+        if err == nil {
+            task := j.createTask(ctx, client, t.which, url, t.merger, t.progress, journal, tempDir)
+            if err = task.Start(); err == nil {
+                tasks[i] = task
+                j.mu.Lock()
+                j.tasks[t.which] = task
+                j.mu.Unlock()
+                continue
+            }
+        }
+        startErr = fmt.Errorf("Unable to start %s download: %v", t.which, err)
+        cancel()
+        merge.MergeNothing(t.merger)
+    }
+
+    //start muxer early so segments can be deleted if keep-files is disabled
+    //for the tcp muxer
+    muxerResult := make(chan error)
+    //stop the downloads if muxing fails, nothing merges their segments
+    //anymore and merge-aware downloads would wait on it forever
+    muxerFailed := false
+    go func() {
+        err := muxer.Mux()
+        if err != nil && ctx.Err() == nil {
+            muxerFailed = true
+            cancel()
+        }
+        muxerResult <- err
+    }()
+
+    for i, task := range tasks {
+        if task == nil {
+            continue
+        }
+        res := task.Wait()
+        *tracks[i].result = res
+        j.emit(DownloadFinished { Track: tracks[i].which, Result: res })
+    }
+
+    if ctx.Err() == nil {
+        j.logger().Info("Waiting for muxing to finish")
+        j.logger().Info("This can take a while for long videos, do NOT restart or all muxing progress will be lost")
+    } else {
+        j.logger().Info("Waiting for muxer to stop")
+    }
+    err = <-muxerResult
+    j.emit(MuxFinished { Output: result.Output, Error: err })
+
+    if startErr != nil {
+        return result, startErr
+    }
+    if muxerFailed {
+        return result, fmt.Errorf("Muxing failed: %v", err)
+    }
+    if ctxErr := ctx.Err(); ctxErr != nil {
+        return result, ctxErr
+    }
+    if err != nil {
+        return result, fmt.Errorf("Muxing failed: %v", err)
+    }
+
+    if !j.opts.KeepFiles {
+        journal.Remove()
+    }
+    if deleteTempDir {
+        //partial downloads of lost segments are still counted otherwise
+        if err = j.opts.TempBudget.RemoveAll(tempDir); err != nil {
+            j.logger().Warnf("Failed to delete temp dir: %v", err)
+        }
+    }
+    return result, nil
+}
+
+// Returns the current progress. Segment totals are -1 until they're known.
+func (j *Job) Status() Status {
+    j.mu.Lock()
+    progress := j.progress
+    status := Status { Merge: j.merged }
+    j.mu.Unlock()
+
+    if progress == nil {
+        status.Audio.Total = -1
+        status.Video.Total = -1
+        return status
+    }
+    status.Audio = progress.Audio().Stats()
+    status.Video = progress.Video().Stats()
+    return status
+}
+
+// Replaces the download URLs with the ones in fregData, which must be for
+// the same video. Useful once the original URLs are about to expire.
+func (j *Job) UpdateURLs(fregData *util.FregJson) error {
+    if fregData.Metadata.Id != j.fregData.Metadata.Id {
+        return fmt.Errorf("Input is for video %s, but %s is being downloaded", fregData.Metadata.Id, j.fregData.Metadata.Id)
+    }
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    for _, task := range j.tasks {
+        itag := task.Itag()
+        url, ok := fregData.Audio[itag]
+        if !ok {
+            url, ok = fregData.Video[itag]
+        }
+        if !ok {
+            task.Logger.Warnf("Reloaded input has no URL for format %d, keeping the old one", itag)
+            continue
+        }
+        if err := task.UpdateURL(url); err != nil {
+            task.Logger.Warnf("Unable to update URL: %v", err)
+        }
+    }
+    return nil
+}
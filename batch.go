@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sync"
+    "text/tabwriter"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+type batchResult struct {
+    input   inputFile
+    started bool
+    result  *archive.Result
+    err     error
+}
+
+func lostSegments(res *download.DownloadResult) int {
+    if res == nil {
+        return 0
+    }
+    return len(res.LostSegments)
+}
+
+// downloads every input, at most --parallel at once. returns whether all
+// of them succeeded.
+func runBatch(ctx context.Context, client *util.HttpClient) bool {
+    if parallel > 1 {
+        log.DisableProgress()
+    }
+    log.Infof("Downloading %d videos, %d at a time", len(inputs), parallel)
+
+    results := make([]batchResult, len(inputs))
+    slots := make(chan struct{}, parallel)
+    var wg sync.WaitGroup
+    for i, in := range inputs {
+        results[i].input = in
+
+        select {
+        case slots <- struct{}{}:
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+            results[i].err = ctx.Err()
+            continue
+        }
+
+        wg.Add(1)
+        go func(r *batchResult) {
+            defer wg.Done()
+            defer func() { <-slots }()
+
+            id := r.input.fregData.Metadata.Id
+            logger := log.New(id)
+
+            //each video gets it's own directory so a failed one can be
+            //resumed on it's own
+            dir := tempDir
+            if dir != "" {
+                dir = filepath.Join(tempDir, id)
+            }
+            opts := jobOptions(client, dir)
+            opts.Logger = logger
+
+            job := newJob(r.input.fregData, opts)
+            watchCtx, stopWatching := context.WithCancel(ctx)
+            go watchInput(watchCtx, job, r.input.path)
+
+            logger.Infof("Starting download from %s", r.input.path)
+            r.started = true
+            r.result, r.err = runJob(ctx, r.input.fregData, job)
+            stopWatching()
+
+            if r.err != nil {
+                logger.Errorf("Failed: %v", r.err)
+            } else {
+                logger.Info("Done")
+            }
+        }(&results[i])
+    }
+    wg.Wait()
+
+    return printSummary(results)
+}
+
+func printSummary(results []batchResult) bool {
+    //stdout might be taken by the JSON progress
+    var out io.Writer = os.Stdout
+    if progressJSON != nil {
+        out = os.Stderr
+    }
+    w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tSTATUS\tLOST AUDIO\tLOST VIDEO\tDETAILS")
+
+    allOk := true
+    resumable := false
+    for _, r := range results {
+        var status, details string
+        var lostAudio, lostVideo int
+        if r.result != nil {
+            lostAudio = lostSegments(r.result.Audio)
+            lostVideo = lostSegments(r.result.Video)
+        }
+        switch {
+        case !r.started:
+            status = "skipped"
+            details = r.input.path
+        case r.err == context.Canceled:
+            status = "stopped"
+            if r.result != nil {
+                details = fmt.Sprintf("segments kept in %s", r.result.TempDir)
+            }
+            resumable = true
+        case r.err != nil:
+            status = "failed"
+            details = r.err.Error()
+        default:
+            status = "ok"
+            details = r.result.Output
+        }
+        if r.err != nil {
+            allOk = false
+        }
+        fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", r.input.fregData.Metadata.Id, status, lostAudio, lostVideo, details)
+    }
+
+    fmt.Fprintf(os.Stderr, "\n")
+    w.Flush()
+
+    if resumable {
+        if tempDir == "" {
+            log.Warn("Some downloads were stopped. Use --temp-dir to be able to resume them by running the same command again")
+        } else {
+            log.Warn("Some downloads were stopped, run the same command again to resume them")
+        }
+    }
+    return allOk
+}
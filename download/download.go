@@ -1,6 +1,8 @@
 package download
 
 import (
+    "bytes"
+    "context"
     "fmt"
     "io"
     "net/http"
@@ -19,6 +21,21 @@ import (
 
 const DefaultFailThreshold = 20
 const DefaultRetryThreshold = 3
+const DefaultLivePollInterval = 15 * time.Second
+const DefaultLiveTimeout = 5 * time.Minute
+
+// amount of consecutive 404/410 responses to the head probe that are treated
+// as the stream being over
+const liveGoneThreshold = 3
+
+type SegmentEvent int
+const (
+    SegmentDone SegmentEvent = iota
+    // already downloaded by a previous run
+    SegmentCached
+    SegmentRequeued
+    SegmentLost
+)
 
 type DownloadResult struct {
     Error         error
@@ -27,31 +44,72 @@ type DownloadResult struct {
 }
 
 type DownloadTask struct {
-    Client         *util.HttpClient
-    FailThreshold  uint
-    Fsync          bool
-    Logger         *log.Logger
-    Merger         merge.Merger
-    Progress       *Progress
-    QueueMode      segments.QueueMode
-    RequeueDelay   time.Duration
-    RequeueFailed  uint
-    RequeueLast    bool
-    RetryThreshold uint
-    SegmentCount   uint
-    SegmentDir     string
-    StartSegment   uint
-    Threads        uint
-    Url            string
-    wg             sync.WaitGroup
-    result         DownloadResult
-    started        bool
-    parsedUrl      *parsedURL
+    Client           *util.HttpClient
+    // stops the download when cancelled, may be nil
+    Context          context.Context
+    FailThreshold    uint
+    Fsync            bool
+    // resume state, may be nil
+    Journal          *TrackJournal
+    // keep polling for new segments until the stream ends
+    Live             bool
+    // how often to poll for new segments in live mode
+    LivePollInterval time.Duration
+    // how long the head segment can stay the same before the stream is
+    // considered over
+    LiveTimeout      time.Duration
+    Logger           *log.Logger
+    // how many segments past the merge position can be downloaded with
+    // QueueMergeAware, segments.DefaultMergeWindow if 0
+    MergeWindow      uint
+    Merger           merge.Merger
+    // called from the download threads whenever a segment is done, lost or
+    // requeued, may be nil
+    OnSegment        func(segment int, event SegmentEvent)
+    Progress         *Progress
+    QueueMode        segments.QueueMode
+    // shared with other tasks to limit their combined throughput, may be nil
+    RateLimiter      *util.RateLimiter
+    RequeueDelay     time.Duration
+    RequeueFailed    uint
+    RequeueLast      bool
+    RetryThreshold   uint
+    SegmentCount     uint
+    SegmentDir       string
+    // don't check downloaded segments before marking them as done
+    SkipValidation   bool
+    StartSegment     uint
+    // bytes per second for this task alone, 0 for no limit
+    TaskRateLimit    int64
+    // counts downloaded segments, shared with the merger deleting them and
+    // other tasks. downloads past the merge position pause while it's
+    // exceeded with QueueMergeAware. may be nil
+    TempBudget       *util.DiskBudget
+    Threads          uint
+    // adjust how many threads work at once between MinThreads and
+    // MaxThreads, starting at Threads, depending on how often the server
+    // throttles requests
+    AdaptiveThreads  bool
+    MaxThreads       uint
+    MinThreads       uint
+    // track name used for metrics, the itag if empty
+    Track            string
+    Url              string
+    wg               sync.WaitGroup
+    result           DownloadResult
+    started          bool
+    // protects Url and parsedUrl once started, they can be replaced with
+    // UpdateURL while downloading
+    urlLock          sync.RWMutex
+    parsedUrl        *parsedURL
+    taskLimiter      *util.RateLimiter
+    // nil unless AdaptiveThreads is set
+    threads          *threadLimiter
 }
 
-func (d *DownloadTask) Start() {
+func (d *DownloadTask) Start() error {
     if d.started {
-        return
+        return nil
     }
 
     if d.FailThreshold < 1 {
@@ -63,32 +121,116 @@ func (d *DownloadTask) Start() {
     if d.Threads < 1 {
         d.Threads = 1
     }
+    if d.AdaptiveThreads {
+        if d.MinThreads < 1 {
+            d.MinThreads = 1
+        }
+        if d.MinThreads > d.Threads {
+            d.MinThreads = d.Threads
+        }
+        if d.MaxThreads < d.Threads {
+            d.MaxThreads = d.Threads
+        }
+    }
+    if d.LivePollInterval <= 0 {
+        d.LivePollInterval = DefaultLivePollInterval
+    }
+    if d.LiveTimeout <= 0 {
+        d.LiveTimeout = DefaultLiveTimeout
+    }
+
+    if d.Context == nil {
+        d.Context = context.Background()
+    }
 
     if len(d.Url) == 0 {
-        log.Fatal("Empty URL")
+        return fmt.Errorf("Empty URL")
     }
     if d.Merger == nil {
-        log.Fatal("Missing Merger")
+        return fmt.Errorf("Missing Merger")
+    }
+    if d.Progress == nil {
+        return fmt.Errorf("Missing Progress")
     }
     if len(d.SegmentDir) == 0 {
-        log.Fatal("Empty SegmentDir")
+        return fmt.Errorf("Empty SegmentDir")
     }
 
     parsedUrl, err := parseDownloadURL(d.Url)
     if err != nil {
-        d.logger().Fatalf("Failed to parse URL: %v", err)
+        return fmt.Errorf("Failed to parse URL: %v", err)
     }
     d.parsedUrl = parsedUrl
+    if d.TaskRateLimit > 0 {
+        d.taskLimiter = util.NewRateLimiter(d.TaskRateLimit)
+    }
+    d.checkExpire(parsedUrl)
+    d.Journal.setItag(parsedUrl.itag)
 
+    d.wg.Add(1)
+    d.started = true
+    go d.run()
+    return nil
+}
+
+func (d *DownloadTask) checkExpire(parsedUrl *parsedURL) {
     if parsedUrl.expire == nil {
         d.logger().Warn("Unable to find 'expire' field in URL")
     } else if now := time.Now(); now.After(*parsedUrl.expire) {
-        d.Logger.Warnf("URL expired %v ago, download will most likely fail", now.Sub(*parsedUrl.expire).Round(time.Second))
+        d.logger().Warnf("URL expired %v ago, download will most likely fail", now.Sub(*parsedUrl.expire).Round(time.Second))
+    }
+}
+
+// returns the current raw and parsed URLs
+func (d *DownloadTask) currentURL() (string, *parsedURL) {
+    d.urlLock.RLock()
+    defer d.urlLock.RUnlock()
+    return d.Url, d.parsedUrl
+}
+
+// Itag of the format being downloaded. Only valid after Start.
+func (d *DownloadTask) Itag() int {
+    _, p := d.currentURL()
+    return p.itag
+}
+
+// Replaces the download URL of a running task, for example once the original
+// one expires. The new URL must be for the same video and format, already
+// downloaded segments and queued work are kept.
+func (d *DownloadTask) UpdateURL(rawUrl string) error {
+    parsedUrl, err := parseDownloadURL(rawUrl)
+    if err != nil {
+        return fmt.Errorf("Failed to parse URL: %v", err)
     }
 
-    d.wg.Add(1)
-    d.started = true
-    go d.run()
+    d.urlLock.Lock()
+    current := d.parsedUrl
+    if current == nil {
+        d.urlLock.Unlock()
+        return fmt.Errorf("Task hasn't been started")
+    }
+    if current.id != parsedUrl.id || current.itag != parsedUrl.itag {
+        d.urlLock.Unlock()
+        return fmt.Errorf(
+            "URL is for %s format %d, expected %s format %d",
+            parsedUrl.id,
+            parsedUrl.itag,
+            current.id,
+            current.itag,
+        )
+    }
+    d.Url = rawUrl
+    d.parsedUrl = parsedUrl
+    d.urlLock.Unlock()
+
+    d.checkExpire(parsedUrl)
+    if parsedUrl.expire != nil {
+        d.logger().Infof("Updated URL, expires in %v", time.Until(*parsedUrl.expire).Round(time.Second))
+    } else {
+        d.logger().Info("Updated URL")
+    }
+    d.Progress.setExpire(parsedUrl.expire)
+    return nil
 }
 
 func (d *DownloadTask) Wait() *DownloadResult {
@@ -96,6 +238,26 @@ func (d *DownloadTask) Wait() *DownloadResult {
     return &d.result
 }
 
+func (d *DownloadTask) segmentEvent(segment int, event SegmentEvent) {
+    id, track := d.metricLabels()
+    segmentsMetric.Inc(id, track, segmentEventNames[event])
+    if d.OnSegment != nil {
+        d.OnSegment(segment, event)
+    }
+}
+
+// sleeps for the duration, returning false if the task got cancelled
+func (d *DownloadTask) sleep(duration time.Duration) bool {
+    timer := time.NewTimer(duration)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-d.Context.Done():
+        return false
+    }
+}
+
 func (d *DownloadTask) logger() *log.Logger {
     if d.Logger != nil {
         return d.Logger
@@ -103,35 +265,137 @@ func (d *DownloadTask) logger() *log.Logger {
     return log.DefaultLogger
 }
 
+// returns the x-head-seqnum value and the response status code (0 if the
+// request itself failed)
+func (d *DownloadTask) fetchHeadSeqnum() (int, int, error) {
+    _, parsedUrl := d.currentURL()
+    info, code, err := probeStream(d.Context, d.Client, parsedUrl)
+    if err != nil {
+        return -1, code, err
+    }
+    return info.HeadSeqnum, code, nil
+}
+
 func (d *DownloadTask) getSegmentCount() (int, error) {
     d.logger().Info("Getting total segments")
 
-    url := d.parsedUrl.SegmentURL(0)
-    resp, err := d.Client.GetRequester().Get(url)
+    segmentCount, _, err := d.fetchHeadSeqnum()
     if err != nil {
         return -1, err
     }
-    defer resp.Body.Close()
+    d.logger().Infof("Total segments: %d", segmentCount)
+
+    return segmentCount, nil
+}
 
-    header := resp.Header.Get("x-head-seqnum")
-    if header == "" {
-        return -1, fmt.Errorf("Unable to get segment count, response status: %s", resp.Status)
+// logs how much of the download is left when resuming
+func (d *DownloadTask) reportResume(segmentCount int) {
+    var missing []int
+    for i := 0; i < segmentCount; i++ {
+        if !util.FileNotEmpty(segmentBaseFileName(d, i) + ".done") {
+            missing = append(missing, i)
+        }
+    }
+    if len(missing) == segmentCount {
+        return
+    }
+    d.logger().Infof("Resuming download, %d/%d segments already downloaded", segmentCount - len(missing), segmentCount)
+    if len(missing) > 0 {
+        d.logger().Infof("Missing segments: %s", formatSegmentRanges(missing, 20))
+        d.logger().Info("Merging starts over from the first segment, so segments deleted after being merged are downloaded again")
     }
+    if lost := d.Journal.previouslyLost(); len(lost) > 0 {
+        d.logger().Infof("Segments lost by the previous run: %s", formatSegmentRanges(lost, 20))
+    }
+    if requeues := d.Journal.previousRequeues(); len(requeues) > 0 {
+        d.logger().Infof("%d segments were requeued by the previous run, their requeue counts carry over", len(requeues))
+    }
+}
 
-    segmentCount, err := strconv.Atoi(header)
-    if err != nil {
-        return -1, fmt.Errorf("Unable to parse x-head-seqnum '%s': %v", header, err)
+// counts segments and partial downloads left by a previous run against the
+// temp budget, they'd only be counted once handed out again otherwise
+func (d *DownloadTask) trackLeftovers(segmentCount int) {
+    if d.TempBudget == nil {
+        return
     }
-    d.logger().Infof("Total segments: %d", segmentCount)
+    for i := 0; i < segmentCount; i++ {
+        base := segmentBaseFileName(d, i)
+        for _, path := range []string { base + ".done", base + ".incomplete" } {
+            if info, err := os.Stat(path); err == nil {
+                d.TempBudget.Track(path, info.Size())
+            }
+        }
+    }
+}
 
-    return segmentCount, nil
+// polls the head sequence number, adding new segments to the status as they
+// show up. returns once the stream is considered over.
+func (d *DownloadTask) followLive(status *segments.SegmentStatus, current int) {
+    defer d.Progress.liveEnded()
+    defer status.EndLive()
+
+    lastChange := time.Now()
+    gone := 0
+    for {
+        if !d.sleep(d.LivePollInterval) {
+            return
+        }
+
+        head, code, err := d.fetchHeadSeqnum()
+        if code == http.StatusNotFound || code == http.StatusGone {
+            gone++
+            if gone >= liveGoneThreshold {
+                d.logger().Infof("Stream is gone (status %d), assuming it ended with %d segments", code, current)
+                d.Journal.setTotal(current, d.StartSegment, true)
+                return
+            }
+        } else {
+            gone = 0
+        }
+
+        if err != nil {
+            d.logger().Debugf("Unable to poll head segment: %v", err)
+        } else if head > current {
+            d.logger().Debugf("Head segment moved from %d to %d", current, head)
+            current = head
+            lastChange = time.Now()
+            d.Journal.setTotal(head, d.StartSegment, false)
+            status.Extend(head)
+            d.Progress.grow(head)
+            continue
+        }
+
+        if since := time.Since(lastChange); since >= d.LiveTimeout {
+            d.logger().Infof("No new segments for %v, assuming stream ended with %d segments", since.Round(time.Second), current)
+            d.Journal.setTotal(current, d.StartSegment, true)
+            return
+        }
+    }
 }
 
 func (d *DownloadTask) run() {
     defer d.wg.Done()
+    defer d.trackExpire()()
+
+    //the muxer waits for the merger, so it has to run even if downloading
+    //can't start
+    mergerStarted := false
+    defer func() {
+        if !mergerStarted {
+            merge.MergeNothing(d.Merger)
+        }
+    }()
 
     var segmentCount int
-    if d.SegmentCount == 0 {
+    live := d.Live
+    if total, ok := d.Journal.total(d.StartSegment); ok && d.SegmentCount == 0 {
+        d.logger().Infof("Using segment count %d from previous run", total)
+        segmentCount = total
+        if live {
+            d.logger().Info("Stream already ended on the previous run, not following it")
+            live = false
+        }
+    } else if d.SegmentCount == 0 {
         var fails []error
         ok := false
         for i := 0; i < 3; i++ {
@@ -139,12 +403,18 @@ func (d *DownloadTask) run() {
             segmentCount, err = d.getSegmentCount()
             if err != nil {
                 fails = append(fails, err)
-                time.Sleep(2 * time.Second)
+                if !d.sleep(2 * time.Second) {
+                    break
+                }
                 continue
             }
             ok = true
             break
         }
+        if err := d.Context.Err(); err != nil {
+            d.result.Error = err
+            return
+        }
         if !ok {
             d.result.Error = fmt.Errorf("Unable to fetch segment count: %v", fails)
             return
@@ -153,15 +423,58 @@ func (d *DownloadTask) run() {
         segmentCount = int(d.SegmentCount)
     }
 
-    d.result.TotalSegments = segmentCount
-
-    d.Progress.init(segmentCount, d.parsedUrl.expire)
+    d.Journal.setTotal(segmentCount, d.StartSegment, !live)
+    d.reportResume(segmentCount)
+    d.trackLeftovers(segmentCount)
+
+    //with adaptive threads, there's a goroutine for as many threads as
+    //there can be, and the limiter decides how many of them work
+    workers := d.Threads
+    if d.AdaptiveThreads {
+        workers = d.MaxThreads
+        d.threads = newThreadLimiter(d.logger(), int(d.Threads), int(d.MinThreads), int(d.MaxThreads))
+        defer d.trackThreads()()
+    }
 
-    segmentStatus := segments.Create(segmentCount, int(d.Threads), d.QueueMode, d.RequeueDelay)
+    _, parsedUrl := d.currentURL()
+    var segmentStatus *segments.SegmentStatus
+    if live {
+        d.logger().Infof("Following live stream, polling every %v", d.LivePollInterval)
+        d.Progress.initLive(segmentCount, parsedUrl.expire)
+        segmentStatus = segments.CreateLive(segmentCount, int(workers), d.QueueMode, d.RequeueDelay)
+        go d.followLive(segmentStatus, segmentCount)
+    } else {
+        d.Progress.init(segmentCount, parsedUrl.expire)
+        segmentStatus = segments.Create(segmentCount, int(workers), d.QueueMode, d.RequeueDelay)
+    }
+    segmentStatus.SeedRequeues(d.Journal.previousRequeues())
+    if d.QueueMode == segments.QueueMergeAware {
+        window := int(d.MergeWindow)
+        if window == 0 {
+            window = segments.DefaultMergeWindow
+        }
+        segmentStatus.SetMergeWindow(window)
+        segmentStatus.SetTempBudget(d.TempBudget)
+    }
     go d.Merger.Merge(segmentStatus)
+    mergerStarted = true
+
+    //stop handing out segments once cancelled, workers exit after their
+    //current request gets aborted
+    finished := make(chan struct{})
+    defer close(finished)
+    go func() {
+        select {
+        case <-d.Context.Done():
+            d.logger().Info("Download cancelled")
+            segmentStatus.Cancel()
+            d.threads.cancel()
+        case <-finished:
+        }
+    }()
 
     var downloadGroup sync.WaitGroup
-    for i := uint(0); i < d.Threads; i++ {
+    for i := uint(0); i < workers; i++ {
         downloadGroup.Add(1)
         go downloadTask(
             i,
@@ -172,7 +485,11 @@ func (d *DownloadTask) run() {
     }
 
     downloadGroup.Wait()
+    d.result.TotalSegments = segmentStatus.Total()
     d.result.LostSegments = segmentStatus.MissedSegments()
+    if segmentStatus.Cancelled() {
+        d.result.Error = d.Context.Err()
+    }
 }
 
 func downloadTask(
@@ -184,14 +501,35 @@ func downloadTask(
     defer wg.Done()
     queue := status.CreateQueue(int(threadNumber))
     requester := task.Client.GetRequester()
+    defer func() { requester.Release() }()
 
     failCount := uint(0)
     networkFailCount := uint(0)
 
     seg := -1
     requeues := uint(0)
+    //threads only hold a slot while they have a segment, so the ones over
+    //the limit don't keep segments from the others
+    working := false
+    defer func() {
+        if working {
+            task.threads.release()
+        }
+    }()
     for {
+        if task.Context.Err() != nil {
+            break
+        }
+        if seg == -1 && working {
+            task.threads.release()
+            working = false
+        }
         if seg == -1 {
+            if !task.threads.acquire() {
+                break
+            }
+            working = true
+
             var ok bool
             seg, requeues, ok = queue.NextSegment()
             if !ok {
@@ -216,6 +554,8 @@ func downloadTask(
 
         if networkFailCount > 3 {
             task.logger().Warnf("Suspicious network failures for segment %d, replacing http client", seg)
+            id, track := task.metricLabels()
+            requesterResetsMetric.Inc(id, track)
 
             requester.Dispose()
             requester = task.Client.GetRequester()
@@ -224,11 +564,20 @@ func downloadTask(
             continue
         }
 
+        //other threads might still be using it, so only release it
+        if !requester.Healthy() {
+            task.logger().Debugf("Thread %d switching away from quarantined address", threadNumber)
+            requester.Release()
+            requester = task.Client.GetRequester()
+        }
+
         if failCount >= fails {
             if requeues < task.RequeueFailed && (!status.IsLast(seg) || task.RequeueLast) {
                 task.logger().Warnf("Failed segment %d, requeue %d/%d", seg, requeues + 1, task.RequeueFailed)
                 queue.RequeueFailed(seg, requeues + 1)
                 task.Progress.requeued(seg)
+                task.Journal.requeued(seg, requeues + 1)
+                task.segmentEvent(seg, SegmentRequeued)
 
                 seg = -1
                 failCount = 0
@@ -239,6 +588,8 @@ func downloadTask(
 
             status.Downloaded(seg, segments.SegmentResult { Ok: false })
             task.Progress.lost()
+            task.Journal.lost(seg)
+            task.segmentEvent(seg, SegmentLost)
 
             seg = -1
             failCount = 0
@@ -250,6 +601,12 @@ func downloadTask(
         ok, cached := downloadSegment(task, requester, status, seg, &networkFailCount)
         if ok {
             task.Progress.done(seg, cached)
+            task.Journal.done(seg)
+            if cached {
+                task.segmentEvent(seg, SegmentCached)
+            } else {
+                task.segmentEvent(seg, SegmentDone)
+            }
 
             seg = -1
             failCount = 0
@@ -263,18 +620,19 @@ func downloadTask(
                 sleepShift = 2
             }
 
-            time.Sleep(time.Duration(1 << sleepShift) * time.Second)
+            task.sleep(time.Duration(1 << sleepShift) * time.Second)
         }
     }
 }
 
 func segmentBaseFileName(task *DownloadTask, segment int) string {
+    _, parsedUrl := task.currentURL()
     return filepath.Join(
         task.SegmentDir,
         fmt.Sprintf(
             "segment-%s_%d.%d",
-            task.parsedUrl.id,
-            task.parsedUrl.itag,
+            parsedUrl.id,
+            parsedUrl.itag,
             segment,
         ),
     )
@@ -286,8 +644,9 @@ func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *
     segmentDonePath := segmentBasePath + ".done"
 
     //already downloaded
-    if util.FileNotEmpty(segmentDonePath) {
+    if info, err := os.Stat(segmentDonePath); err == nil && info.Size() > 0 {
         task.logger().Debugf("Segment %d already downloaded", segment)
+        task.TempBudget.Track(segmentDonePath, info.Size())
         status.Downloaded(segment, segments.SegmentResult {
             Ok: true,
             Filename: segmentDonePath,
@@ -295,14 +654,23 @@ func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *
         return true, true
     }
 
-    targetUrl := task.parsedUrl.SegmentURL(task.StartSegment + uint(segment))
+    rawUrl, parsedUrl := task.currentURL()
+    targetUrl := parsedUrl.SegmentURL(task.StartSegment + uint(segment))
 
-    req, err := http.NewRequest("GET", targetUrl, nil)
+    req, err := http.NewRequestWithContext(task.Context, "GET", targetUrl, nil)
     if err != nil {
-        task.logger().Fatalf("Unable to create http request: %v", err)
+        task.logger().Errorf("Unable to create http request: %v", err)
+        return false, false
     }
     req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/89.0.4389.90 Safari/537.36")
 
+    //continue where a previous attempt stopped
+    var offset int64
+    if info, err := os.Stat(segmentDownloadPath); err == nil && info.Size() > 0 {
+        offset = info.Size()
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+
     resp, err := doRequest(task, requester, req)
     if err != nil {
         *networkErrors++
@@ -311,9 +679,33 @@ func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *
     }
     defer resp.Body.Close()
 
-    if resp.StatusCode != 200 {
+    id, track := task.metricLabels()
+    responsesMetric.Inc(id, track, strconv.Itoa(resp.StatusCode))
+    task.threads.record(resp.StatusCode)
+
+    if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+        //the partial file is as long as the segment or longer, it can't be
+        //trusted either way
+        task.logger().Debugf("Partial data for segment %d doesn't match the server's, downloading it again", segment)
+        task.TempBudget.Remove(segmentDownloadPath)
+        return false, false
+    }
+
+    total := resp.ContentLength
+    resumed := false
+    if resp.StatusCode == http.StatusPartialContent && offset > 0 {
+        start, length, ok := parseContentRange(resp.Header.Get("Content-Range"))
+        if !ok || start != offset {
+            task.logger().Debugf("Unexpected range '%s' for segment %d, downloading it again", resp.Header.Get("Content-Range"), segment)
+            task.TempBudget.Remove(segmentDownloadPath)
+            return false, false
+        }
+        task.logger().Debugf("Resuming segment %d from byte %d", segment, offset)
+        total = length
+        resumed = true
+    } else if resp.StatusCode != 200 {
         task.logger().Debugf("Non-200 status code %d for segment %d", resp.StatusCode, segment)
-        req, err = http.NewRequest("GET", task.Url, nil)
+        req, err = http.NewRequestWithContext(task.Context, "GET", rawUrl, nil)
         if err == nil {
             resp, err = doRequest(task, requester, req)
             if resp != nil {
@@ -323,39 +715,92 @@ func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *
         return false, false
     }
 
-    file, err := os.OpenFile(segmentDownloadPath, os.O_RDWR|os.O_CREATE, 0644)
+    //the server ignored the range otherwise, so start over
+    flags := os.O_RDWR|os.O_CREATE|os.O_TRUNC
+    if resumed {
+        flags = os.O_RDWR|os.O_APPEND
+    }
+    file, err := os.OpenFile(segmentDownloadPath, flags, 0644)
     if err != nil {
         task.logger().Warnf("Unable to create temp file for segment %d: %v", segment, err)
         return false, false
     }
     defer file.Close()
 
-    if _, err = io.Copy(file, resp.Body); err != nil {
-        os.Remove(file.Name())
-        task.logger().Errorf("Unable to write segment %d: %v", segment, err)
+    var data bytes.Buffer
+    var writer io.Writer = file
+    if !task.SkipValidation {
+        //validation needs the whole segment
+        if resumed {
+            if _, err = io.Copy(&data, file); err != nil {
+                file.Close()
+                task.TempBudget.Remove(segmentDownloadPath)
+                task.logger().Warnf("Unable to read partial data for segment %d: %v", segment, err)
+                return false, false
+            }
+        }
+        writer = io.MultiWriter(file, &data)
+    }
+
+    body := util.LimitReader(task.Context, resp.Body, task.RateLimiter, task.taskLimiter)
+    written, err := io.Copy(writer, body)
+    bytesMetric.Add(float64(written), id, track)
+    task.Progress.received(written)
+    if resumed {
+        written += offset
+    }
+    if err != nil {
+        //what was received so far is kept, so the next attempt can resume
+        //from there
+        file.Close()
+        task.TempBudget.Track(segmentDownloadPath, written)
+        //aborted by a cancellation, not a real failure
+        if task.Context.Err() != nil {
+            task.logger().Debugf("Download of segment %d aborted", segment)
+        } else {
+            task.logger().Errorf("Unable to write segment %d: %v", segment, err)
+        }
         return false, false
     }
 
+    if resumed && total >= 0 && written != total {
+        file.Close()
+        task.TempBudget.Remove(segmentDownloadPath)
+        task.logger().Warnf("Resumed segment %d has %d bytes, expected %d", segment, written, total)
+        return false, false
+    }
+
+    if !task.SkipValidation {
+        if err = validateSegment(task, resp, written, total, data.Bytes(), segment); err != nil {
+            file.Close()
+            task.TempBudget.Remove(segmentDownloadPath)
+            task.logger().Warnf("Invalid data for segment %d: %v", segment, err)
+            return false, false
+        }
+    }
+
     if task.Fsync {
         if err = file.Sync(); err != nil {
-            os.Remove(file.Name())
+            task.TempBudget.Remove(segmentDownloadPath)
             task.logger().Errorf("Unable to sync segment %d: %v", segment, err)
             return false, false
         }
     }
     if err = file.Close(); err != nil {
-        os.Remove(file.Name())
+        task.TempBudget.Remove(segmentDownloadPath)
         task.logger().Errorf("Unable to close file for segment %d: %v", segment, err)
         return false, false
     }
 
-    if err = os.Rename(segmentDownloadPath, segmentDonePath); err != nil {
-        os.Remove(segmentDownloadPath)
+    if err = task.TempBudget.Rename(segmentDownloadPath, segmentDonePath); err != nil {
+        task.TempBudget.Remove(segmentDownloadPath)
         task.logger().Errorf("Unable to rename segment %d: %v", segment, err)
         return false, false
     }
-    task.logger().Debugf("Downloaded segment %d", segment)
+    task.logger().Debugf("Downloaded segment %d over %s", segment, resp.Proto)
 
+    //before handing it to the merger, which might delete it right away
+    task.TempBudget.Track(segmentDonePath, written)
     status.Downloaded(segment, segments.SegmentResult {
         Ok: true,
         Filename: segmentDonePath,
@@ -364,6 +809,46 @@ func downloadSegment(task *DownloadTask, requester *util.HttpRequester, status *
     return true, false
 }
 
+// total is the length the server said the segment has, -1 if unknown
+func validateSegment(task *DownloadTask, resp *http.Response, written, total int64, data []byte, segment int) error {
+    if total >= 0 && written != total {
+        return fmt.Errorf("Got %d bytes, expected %d", written, total)
+    }
+
+    expected := uint64(task.StartSegment) + uint64(segment)
+    if header := resp.Header.Get("x-sequence-num"); header != "" {
+        if sq, err := strconv.ParseUint(header, 10, 64); err == nil && sq != expected {
+            return fmt.Errorf("Response is for sequence number %d, expected %d", sq, expected)
+        }
+    }
+    if sq, ok := merge.SegmentSequenceNumber(data); ok && sq != expected {
+        return fmt.Errorf("Segment has sequence number %d, expected %d", sq, expected)
+    }
+
+    return merge.ValidateSegment(data)
+}
+
+// parses a "bytes START-END/LENGTH" Content-Range header, the length is -1
+// if the server doesn't know it
+func parseContentRange(header string) (int64, int64, bool) {
+    var start, end int64
+    var length string
+    if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &length); err != nil {
+        return 0, 0, false
+    }
+    if end < start {
+        return 0, 0, false
+    }
+    if length == "*" {
+        return start, -1, true
+    }
+    total, err := strconv.ParseInt(length, 10, 64)
+    if err != nil || total <= end {
+        return 0, 0, false
+    }
+    return start, total, true
+}
+
 func doRequest(task *DownloadTask, requester *util.HttpRequester, req *http.Request) (*http.Response, error) {
     var errors []error
     for i := uint(0); i < task.RetryThreshold; i++ {
@@ -372,6 +857,9 @@ func doRequest(task *DownloadTask, requester *util.HttpRequester, req *http.Requ
             return resp, nil
         }
         errors = append(errors, err)
+        if task.Context.Err() != nil {
+            break
+        }
     }
     return nil, fmt.Errorf("All requests failed: %v", errors)
 }
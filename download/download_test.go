@@ -0,0 +1,30 @@
+package download
+
+import (
+    "testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+    tests := []struct {
+        header string
+        start  int64
+        total  int64
+        ok     bool
+    } {
+        { header: "bytes 0-99/100", start: 0, total: 100, ok: true },
+        { header: "bytes 100-199/1000", start: 100, total: 1000, ok: true },
+        { header: "bytes 100-199/*", start: 100, total: -1, ok: true },
+        { header: "bytes 100-99/1000", ok: false },
+        { header: "bytes 0-99/99", ok: false },
+        { header: "bytes 0-99/abc", ok: false },
+        { header: "bytes */1000", ok: false },
+        { header: "", ok: false },
+    }
+    for _, test := range tests {
+        start, total, ok := parseContentRange(test.header)
+        if ok != test.ok || start != test.start || total != test.total {
+            t.Errorf("parseContentRange('%s') = (%d, %d, %v), expected (%d, %d, %v)",
+                test.header, start, total, ok, test.start, test.total, test.ok)
+        }
+    }
+}
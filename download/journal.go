@@ -0,0 +1,341 @@
+package download
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+const journalFlushInterval = 5 * time.Second
+
+type trackState struct {
+    Itag          int          `json:"itag"`
+    StartSegment  uint         `json:"startSegment"`
+    TotalSegments int          `json:"totalSegments"`
+    // false while a live stream might still add segments
+    TotalFinal    bool         `json:"totalFinal"`
+    Lost          []int        `json:"lost"`
+    Requeues      map[int]uint `json:"requeues"`
+}
+
+type journalState struct {
+    Id     string                 `json:"id"`
+    Tracks map[string]*trackState `json:"tracks"`
+}
+
+// Persistent state of a download, stored in the temporary directory so a
+// restarted download can pick up where the previous one left off.
+type Journal struct {
+    mu     sync.Mutex
+    path   string
+    dirty  bool
+    loaded bool
+    state  journalState
+    stop   chan struct{}
+    done   chan struct{}
+}
+
+// Loads the journal at path, or starts a new one if it doesn't exist or is
+// for another video. The returned journal is always usable, the error only
+// reports problems with the previous state.
+func OpenJournal(path string, id string) (*Journal, error) {
+    j := &Journal {
+        path:  path,
+        state: journalState {
+            Id:     id,
+            Tracks: make(map[string]*trackState),
+        },
+        stop:  make(chan struct{}),
+        done:  make(chan struct{}),
+    }
+    go j.flushLoop()
+
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return j, nil
+    }
+    if err != nil {
+        return j, fmt.Errorf("Unable to read journal: %v", err)
+    }
+
+    var state journalState
+    if err = json.Unmarshal(data, &state); err != nil {
+        return j, fmt.Errorf("Unable to parse journal: %v", err)
+    }
+    if state.Id != id {
+        return j, fmt.Errorf("Journal is for video %s, ignoring it", state.Id)
+    }
+    if state.Tracks != nil {
+        j.state.Tracks = state.Tracks
+    }
+    j.loaded = true
+    return j, nil
+}
+
+// Whether the journal contains state from a previous run.
+func (j *Journal) Loaded() bool {
+    return j != nil && j.loaded
+}
+
+// Itag used for a track ("audio" or "video") by a previous run.
+func (j *Journal) Itag(which string) (int, bool) {
+    if j == nil {
+        return 0, false
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    t, ok := j.state.Tracks[which]
+    if !ok || t.Itag == 0 {
+        return 0, false
+    }
+    return t.Itag, true
+}
+
+func (j *Journal) Track(which string) *TrackJournal {
+    if j == nil {
+        return nil
+    }
+    return &TrackJournal {
+        journal: j,
+        which:   which,
+    }
+}
+
+func (j *Journal) flushLoop() {
+    defer close(j.done)
+    ticker := time.NewTicker(journalFlushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-j.stop:
+            return
+        case <-ticker.C:
+            if err := j.Flush(); err != nil {
+                log.Warnf("Unable to write journal: %v", err)
+            }
+        }
+    }
+}
+
+// Writes pending changes to disk.
+func (j *Journal) Flush() error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if !j.dirty {
+        return nil
+    }
+
+    data, err := json.Marshal(&j.state)
+    if err != nil {
+        return err
+    }
+    //write to a temporary file first so a crash never leaves a corrupt journal
+    tmp := j.path + ".tmp"
+    if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    if err = os.Rename(tmp, j.path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    j.dirty = false
+    return nil
+}
+
+// Stops the periodic flushing and writes pending changes.
+func (j *Journal) Close() {
+    if j == nil {
+        return
+    }
+    select {
+    case <-j.stop:
+        return
+    default:
+    }
+    close(j.stop)
+    <-j.done
+    if err := j.Flush(); err != nil {
+        log.Warnf("Unable to write journal: %v", err)
+    }
+}
+
+// Closes and deletes the journal, once it's no longer needed.
+func (j *Journal) Remove() {
+    if j == nil {
+        return
+    }
+    j.Close()
+    if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+        log.Warnf("Unable to delete journal: %v", err)
+    }
+}
+
+func (j *Journal) update(which string, f func(*trackState)) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    t, ok := j.state.Tracks[which]
+    if !ok {
+        t = &trackState {}
+        j.state.Tracks[which] = t
+    }
+    if t.Requeues == nil {
+        t.Requeues = make(map[int]uint)
+    }
+    f(t)
+    j.dirty = true
+}
+
+// Journal of a single track. All methods are safe to call on a nil journal.
+type TrackJournal struct {
+    journal *Journal
+    which   string
+}
+
+func (t *TrackJournal) setItag(itag int) {
+    if t == nil {
+        return
+    }
+    t.journal.update(t.which, func(s *trackState) {
+        if s.Itag != itag {
+            //segments of the old format are useless now
+            *s = trackState {
+                Itag:     itag,
+                Requeues: make(map[int]uint),
+            }
+        }
+    })
+}
+
+// segment count saved by a previous run, if it's known to be final
+func (t *TrackJournal) total(startSegment uint) (int, bool) {
+    if t == nil {
+        return 0, false
+    }
+    t.journal.mu.Lock()
+    defer t.journal.mu.Unlock()
+    s, ok := t.journal.state.Tracks[t.which]
+    if !ok || !s.TotalFinal || s.TotalSegments <= 0 || s.StartSegment != startSegment {
+        return 0, false
+    }
+    return s.TotalSegments, true
+}
+
+// segments lost by a previous run
+func (t *TrackJournal) previouslyLost() []int {
+    if t == nil {
+        return nil
+    }
+    t.journal.mu.Lock()
+    defer t.journal.mu.Unlock()
+    s, ok := t.journal.state.Tracks[t.which]
+    if !ok {
+        return nil
+    }
+    return append([]int(nil), s.Lost...)
+}
+
+// how many times segments were requeued by a previous run, for segments
+// that weren't downloaded or lost yet
+func (t *TrackJournal) previousRequeues() map[int]uint {
+    if t == nil {
+        return nil
+    }
+    t.journal.mu.Lock()
+    defer t.journal.mu.Unlock()
+    s, ok := t.journal.state.Tracks[t.which]
+    if !ok || len(s.Requeues) == 0 {
+        return nil
+    }
+    requeues := make(map[int]uint, len(s.Requeues))
+    for k, v := range s.Requeues {
+        requeues[k] = v
+    }
+    return requeues
+}
+
+func (t *TrackJournal) setTotal(total int, startSegment uint, final bool) {
+    if t == nil {
+        return
+    }
+    t.journal.update(t.which, func(s *trackState) {
+        if s.StartSegment != startSegment {
+            s.Lost = nil
+            s.Requeues = make(map[int]uint)
+        }
+        s.StartSegment = startSegment
+        s.TotalSegments = total
+        s.TotalFinal = final
+    })
+}
+
+func (t *TrackJournal) requeued(segment int, requeues uint) {
+    if t == nil {
+        return
+    }
+    t.journal.update(t.which, func(s *trackState) {
+        s.Requeues[segment] = requeues
+    })
+}
+
+func (t *TrackJournal) lost(segment int) {
+    if t == nil {
+        return
+    }
+    t.journal.update(t.which, func(s *trackState) {
+        delete(s.Requeues, segment)
+        for _, v := range s.Lost {
+            if v == segment {
+                return
+            }
+        }
+        s.Lost = append(s.Lost, segment)
+        sort.Ints(s.Lost)
+    })
+}
+
+func (t *TrackJournal) done(segment int) {
+    if t == nil {
+        return
+    }
+    t.journal.update(t.which, func(s *trackState) {
+        delete(s.Requeues, segment)
+        for i, v := range s.Lost {
+            if v == segment {
+                s.Lost = append(s.Lost[:i], s.Lost[i + 1:]...)
+                break
+            }
+        }
+    })
+}
+
+// formats a sorted list of segments as ranges, eg "1-5, 7, 9-12"
+func formatSegmentRanges(list []int, maxRanges int) string {
+    var parts []string
+    for i := 0; i < len(list); {
+        j := i
+        for j + 1 < len(list) && list[j + 1] == list[j] + 1 {
+            j++
+        }
+        if len(parts) == maxRanges {
+            parts = append(parts, "...")
+            break
+        }
+        if i == j {
+            parts = append(parts, fmt.Sprintf("%d", list[i]))
+        } else {
+            parts = append(parts, fmt.Sprintf("%d-%d", list[i], list[j]))
+        }
+        i = j + 1
+    }
+    return strings.Join(parts, ", ")
+}
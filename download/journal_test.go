@@ -0,0 +1,119 @@
+package download
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "abc.state.json")
+    j, err := OpenJournal(path, "abc")
+    if err != nil {
+        t.Fatalf("Unable to open new journal: %v", err)
+    }
+    if j.Loaded() {
+        t.Error("New journal claims to be loaded")
+    }
+    audio := j.Track("audio")
+    audio.setItag(140)
+    audio.setTotal(100, 0, true)
+    audio.lost(5)
+    audio.lost(3)
+    audio.done(5)
+    audio.requeued(7, 2)
+    audio.requeued(8, 1)
+    audio.done(8)
+    j.Close()
+
+    j, err = OpenJournal(path, "abc")
+    if err != nil {
+        t.Fatalf("Unable to reopen journal: %v", err)
+    }
+    defer j.Remove()
+    if !j.Loaded() {
+        t.Fatal("Journal wasn't loaded")
+    }
+    if itag, ok := j.Itag("audio"); !ok || itag != 140 {
+        t.Errorf("Expected itag 140, got %d (ok: %v)", itag, ok)
+    }
+    if _, ok := j.Itag("video"); ok {
+        t.Error("Got an itag for a track that was never saved")
+    }
+    audio = j.Track("audio")
+    if total, ok := audio.total(0); !ok || total != 100 {
+        t.Errorf("Expected 100 segments, got %d (ok: %v)", total, ok)
+    }
+    if _, ok := audio.total(1); ok {
+        t.Error("Got a segment count for another start segment")
+    }
+    if lost := audio.previouslyLost(); len(lost) != 1 || lost[0] != 3 {
+        t.Errorf("Expected segment 3 to be lost, got %v", lost)
+    }
+    if requeues := audio.previousRequeues(); len(requeues) != 1 || requeues[7] != 2 {
+        t.Errorf("Expected segment 7 to be requeued twice, got %v", requeues)
+    }
+}
+
+func TestJournalReset(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "abc.state.json")
+    j, _ := OpenJournal(path, "abc")
+    audio := j.Track("audio")
+    audio.setItag(140)
+    audio.setTotal(100, 0, false)
+    audio.lost(3)
+    audio.requeued(7, 2)
+
+    //not final yet, so it can't be trusted
+    if _, ok := audio.total(0); ok {
+        t.Error("Got a segment count that isn't final")
+    }
+    //segment numbers mean something else from another start segment
+    audio.setTotal(100, 50, true)
+    if lost, requeues := audio.previouslyLost(), audio.previousRequeues(); len(lost) != 0 || len(requeues) != 0 {
+        t.Errorf("Start segment change kept lost %v and requeues %v", lost, requeues)
+    }
+    audio.lost(3)
+    audio.setItag(251)
+    if _, ok := audio.total(50); ok || len(audio.previouslyLost()) != 0 {
+        t.Error("Format change kept the segments of the old format")
+    }
+    j.Close()
+
+    j, err := OpenJournal(path, "xyz")
+    if err == nil {
+        t.Error("Journal of another video was accepted")
+    }
+    if j.Loaded() {
+        t.Error("Journal of another video was loaded")
+    }
+    j.Close()
+}
+
+func TestNilJournal(t *testing.T) {
+    var j *Journal
+    track := j.Track("audio")
+    track.setItag(140)
+    track.lost(1)
+    if track.previouslyLost() != nil || track.previousRequeues() != nil || j.Loaded() {
+        t.Error("Nil journal has state")
+    }
+    j.Close()
+}
+
+func TestFormatSegmentRanges(t *testing.T) {
+    tests := []struct {
+        list     []int
+        max      int
+        expected string
+    } {
+        { list: nil, max: 10, expected: "" },
+        { list: []int { 4 }, max: 10, expected: "4" },
+        { list: []int { 1, 2, 3, 5, 7, 8 }, max: 10, expected: "1-3, 5, 7-8" },
+        { list: []int { 1, 2, 3, 5, 7, 8 }, max: 2, expected: "1-3, 5, ..." },
+    }
+    for _, test := range tests {
+        if got := formatSegmentRanges(test.list, test.max); got != test.expected {
+            t.Errorf("formatSegmentRanges(%v, %d) = '%s', expected '%s'", test.list, test.max, got, test.expected)
+        }
+    }
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+    "math"
+    "strconv"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+)
+
+var (
+    segmentsMetric = metrics.NewCounter(
+        "ytarchive_segments_total",
+        "Segments handled by the download threads, by result (downloaded, cached, requeued or lost).",
+        "video_id", "track", "result",
+    )
+    bytesMetric = metrics.NewCounter(
+        "ytarchive_downloaded_bytes_total",
+        "Bytes of segment data received.",
+        "video_id", "track",
+    )
+    responsesMetric = metrics.NewCounter(
+        "ytarchive_segment_responses_total",
+        "HTTP responses to segment requests, by status code.",
+        "video_id", "track", "code",
+    )
+    requesterResetsMetric = metrics.NewCounter(
+        "ytarchive_requester_resets_total",
+        "HTTP clients replaced because of repeated network failures.",
+        "video_id", "track",
+    )
+    threadsMetric = metrics.NewGauge(
+        "ytarchive_download_threads",
+        "How many threads are allowed to download at once, with adaptive threads.",
+        "video_id", "track",
+    )
+    expireMetric = metrics.NewGauge(
+        "ytarchive_url_expires_in_seconds",
+        "Time until the download URL expires, negative once it has. NaN if the URL has no expiration.",
+        "video_id", "track",
+    )
+)
+
+var segmentEventNames = map[SegmentEvent]string {
+    SegmentDone:     "downloaded",
+    SegmentCached:   "cached",
+    SegmentRequeued: "requeued",
+    SegmentLost:     "lost",
+}
+
+// video id and track labels of the task's metrics
+func (d *DownloadTask) metricLabels() (string, string) {
+    _, p := d.currentURL()
+    track := d.Track
+    if track == "" {
+        track = strconv.Itoa(p.itag)
+    }
+    return p.id, track
+}
+
+// reports the expiration of whatever the current URL is until the task ends
+func (d *DownloadTask) trackExpire() func() {
+    id, track := d.metricLabels()
+    expireMetric.SetFunc(func() float64 {
+        _, p := d.currentURL()
+        if p.expire == nil {
+            return math.NaN()
+        }
+        return time.Until(*p.expire).Seconds()
+    }, id, track)
+    return func() {
+        expireMetric.Delete(id, track)
+    }
+}
+
+func (d *DownloadTask) trackThreads() func() {
+    id, track := d.metricLabels()
+    threadsMetric.SetFunc(func() float64 {
+        return float64(d.threads.current())
+    }, id, track)
+    return func() {
+        threadsMetric.Delete(id, track)
+    }
+}
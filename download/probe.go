@@ -0,0 +1,95 @@
+package download
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// headers with the time at which the newest segment starts, in order of
+// preference
+var headTimeHeaders = []struct {
+    name string
+    unit time.Duration
+} {
+    { name: "x-head-time-ms",     unit: time.Millisecond },
+    { name: "x-head-time-millis", unit: time.Millisecond },
+    { name: "x-head-time-sec",    unit: time.Second },
+}
+
+// What the server says about a stream when requesting one of its segments
+type StreamInfo struct {
+    // size of the first segment, -1 if unknown
+    FirstSegmentSize int64
+    // newest segment, which is the segment count once the stream is over
+    HeadSeqnum       int
+    // how far into the stream the newest segment starts, 0 if unknown
+    HeadTime         time.Duration
+}
+
+// Average duration of the segments up to the newest one, 0 if unknown
+func (s *StreamInfo) SegmentDuration() time.Duration {
+    if s.HeadSeqnum <= 0 || s.HeadTime <= 0 {
+        return 0
+    }
+    return s.HeadTime / time.Duration(s.HeadSeqnum)
+}
+
+// requests the first segment and reads the stream info from the response
+// headers. also returns the response status code (0 if the request itself
+// failed)
+func probeStream(ctx context.Context, client *util.HttpClient, parsedUrl *parsedURL) (*StreamInfo, int, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", parsedUrl.SegmentURL(0), nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    requester := client.GetRequester()
+    defer requester.Release()
+    resp, err := requester.Do(req)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer resp.Body.Close()
+
+    header := resp.Header.Get("x-head-seqnum")
+    if header == "" {
+        return nil, resp.StatusCode, fmt.Errorf("Unable to get segment count, response status: %s", resp.Status)
+    }
+
+    info := &StreamInfo { FirstSegmentSize: -1 }
+    if resp.StatusCode == http.StatusOK {
+        info.FirstSegmentSize = resp.ContentLength
+    }
+    info.HeadSeqnum, err = strconv.Atoi(header)
+    if err != nil {
+        return nil, resp.StatusCode, fmt.Errorf("Unable to parse x-head-seqnum '%s': %v", header, err)
+    }
+    for _, h := range headTimeHeaders {
+        value := resp.Header.Get(h.name)
+        if value == "" {
+            continue
+        }
+        t, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return nil, resp.StatusCode, fmt.Errorf("Unable to parse %s '%s': %v", h.name, value, err)
+        }
+        info.HeadTime = time.Duration(t) * h.unit
+        break
+    }
+    return info, resp.StatusCode, nil
+}
+
+// Requests the first segment of a download URL to find how long the stream
+// is so far, for example to map times to segment numbers.
+func ProbeStream(ctx context.Context, client *util.HttpClient, rawUrl string) (*StreamInfo, error) {
+    parsedUrl, err := parseDownloadURL(rawUrl)
+    if err != nil {
+        return nil, fmt.Errorf("Failed to parse URL: %v", err)
+    }
+    info, _, err := probeStream(ctx, client, parsedUrl)
+    return info, err
+}
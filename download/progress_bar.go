@@ -7,8 +7,12 @@ import (
     "time"
 
     "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
+// how long the download rate is averaged over
+const rateWindow = 3 * time.Second
+
 const (
     colorGreen   = "\033[32m"
     colorMagenta = "\033[35m"
@@ -18,15 +22,81 @@ const (
 )
 
 type Progress struct {
-    parent     *TotalProgress
-    cached     int
-    downloaded int
-    failed     int
-    total      int
-    requeues   map[int]struct{}
-    start      time.Time
-    end        time.Time
-    expire     *time.Time
+    parent      *TotalProgress
+    cached      int
+    downloaded  int
+    failed      int
+    total       int
+    // total keeps growing until the stream ends
+    live        bool
+    requeues    map[int]struct{}
+    start       time.Time
+    end         time.Time
+    expire      *time.Time
+    // bytes received since windowStart, turned into rate once the window
+    // is over
+    window      int64
+    windowStart time.Time
+    rate        float64
+    rateTime    time.Time
+}
+
+// A snapshot of the download progress of a track
+type ProgressStats struct {
+    // -1 until the segment count is known
+    Total      int
+    Downloaded int
+    Cached     int
+    Lost       int
+    // segments currently waiting to be retried
+    Requeued   int
+    Live       bool
+    // -1 if unknown
+    ETA        time.Duration
+    // recent download rate in bytes per second
+    Rate       float64
+}
+
+func (p *Progress) Stats() ProgressStats {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    return ProgressStats {
+        Total:      p.total,
+        Downloaded: p.downloaded,
+        Cached:     p.cached,
+        Lost:       p.failed,
+        Requeued:   len(p.requeues),
+        Live:       p.live,
+        ETA:        p.eta(),
+        Rate:       p.currentRate(),
+    }
+}
+
+func (p *Progress) received(bytes int64) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    now := time.Now()
+    if p.windowStart.IsZero() {
+        p.windowStart = now
+    }
+    p.window += bytes
+    if elapsed := now.Sub(p.windowStart); elapsed >= rateWindow {
+        p.rate = float64(p.window) / elapsed.Seconds()
+        p.rateTime = now
+        p.window = 0
+        p.windowStart = now
+    }
+}
+
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) currentRate() float64 {
+    //nothing received for a while
+    if time.Since(p.rateTime) > 3 * rateWindow {
+        return 0
+    }
+    return p.rate
 }
 
 func (p *Progress) init(totalSegments int, expire *time.Time) {
@@ -39,6 +109,43 @@ func (p *Progress) init(totalSegments int, expire *time.Time) {
     p.updated()
 }
 
+func (p *Progress) initLive(totalSegments int, expire *time.Time) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.total = totalSegments
+    p.start = time.Now()
+    p.expire = expire
+    p.live = true
+    p.updated()
+}
+
+func (p *Progress) grow(totalSegments int) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    if totalSegments > p.total {
+        p.total = totalSegments
+        p.updated()
+    }
+}
+
+func (p *Progress) liveEnded() {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.live = false
+    p.updated()
+}
+
+func (p *Progress) setExpire(expire *time.Time) {
+    p.parent.mu.Lock()
+    defer p.parent.mu.Unlock()
+
+    p.expire = expire
+    p.updated()
+}
+
 func (p *Progress) lost() {
     p.parent.mu.Lock()
     defer p.parent.mu.Unlock()
@@ -71,7 +178,7 @@ func (p *Progress) done(segment int, cached bool) {
 }
 
 func (p *Progress) updated() {
-    if p.cached + p.downloaded + p.failed == p.total {
+    if !p.live && p.cached + p.downloaded + p.failed == p.total {
         p.end = time.Now()
     }
 
@@ -85,6 +192,23 @@ func (p *Progress) pct() float64 {
     return float64(finished) / float64(p.total) * 100
 }
 
+//NOT thread safe, should NOT acquire locks
+func (p *Progress) eta() time.Duration {
+    //don't include eta without downloading a bit
+    if p.live || p.total < 0 || p.downloaded <= 100 {
+        return -1
+    }
+    if p.cached + p.downloaded + p.failed == p.total {
+        return 0
+    }
+
+    elapsed := time.Since(p.start)
+
+    etaProgress := float64(p.downloaded + p.failed) / float64(p.total - p.cached)
+    etaSeconds := (1.0 / etaProgress) * elapsed.Seconds()
+    return (time.Duration(int64(etaSeconds)) * time.Second) - elapsed
+}
+
 //NOT thread safe, should NOT acquire locks
 func (p *Progress) fmt() string {
     if p.total == -1 {
@@ -106,6 +230,23 @@ func (p *Progress) fmt() string {
         }
         return fmt.Sprintf(", %srequeued %d%s", colorMagenta, len(p.requeues), color)
     }
+    rateString := ""
+    if rate := p.currentRate(); rate > 0 {
+        rateString = fmt.Sprintf(", %s/s", util.FormatByteSize(rate))
+    }
+
+    if p.live {
+        return fmt.Sprintf(
+            "%slive, %d/%d%s%s%s (following stream)%s",
+            colorYellow,
+            successful,
+            p.total,
+            requeuedString(colorYellow),
+            lostString(colorYellow),
+            rateString,
+            colorReset,
+        )
+    }
 
     if finished == p.total {
         color := colorGreen
@@ -125,38 +266,33 @@ func (p *Progress) fmt() string {
 
     progress := float64(finished) / float64(p.total)
 
-    //don't include eta without downloading a bit
-    if p.downloaded > 100 {
-        elapsed := time.Since(p.start)
-
-        etaProgress := float64(p.downloaded + p.failed) / float64(p.total - p.cached)
-        etaSeconds := (1.0 / etaProgress) * elapsed.Seconds()
-        eta := (time.Duration(int64(etaSeconds)) * time.Second) - elapsed
-
+    if eta := p.eta(); eta >= 0 {
         color := colorYellow
         if p.expire != nil && p.start.Add(eta).After(*p.expire) {
             color = colorRed
         }
         return fmt.Sprintf(
-            "%s%.2f%% (%d/%d%s%s, eta %s)%s",
+            "%s%.2f%% (%d/%d%s%s%s, eta %s)%s",
             color,
             progress * 100,
             successful,
             p.total,
             requeuedString(color),
             lostString(color),
+            rateString,
             formatDuration(eta),
             colorReset,
         )
     } else {
         return fmt.Sprintf(
-            "%s%.2f%% (%d/%d%s%s, eta unknown)%s",
+            "%s%.2f%% (%d/%d%s%s%s, eta unknown)%s",
             colorYellow,
             progress * 100,
             successful,
             p.total,
             requeuedString(colorYellow),
             lostString(colorYellow),
+            rateString,
             colorReset,
         )
     }
@@ -3,18 +3,36 @@ package segments
 import (
     "sync"
     "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
 type QueueMode int
 const (
     QueueSequential QueueMode = iota
     QueueOutOfOrder
+    // like QueueSequential, but retries the segments closest to the merge
+    // position first and can limit how far ahead of it downloads get, see
+    // SetMergeWindow
+    QueueMergeAware
 )
 
+// how many segments past the merge position QueueMergeAware downloads by
+// default
+const DefaultMergeWindow = 100
+
 type SegmentStatus struct {
     mu           sync.Mutex
+    cancelled    bool
+    // closed and replaced whenever a segment is downloaded or the status
+    // changes, to wake up whoever waits on it
+    changed      chan struct{}
     end          int
+    // false while more segments might still be added with Extend
+    ended        bool
     mergedCount  int
+    // requeue counts from a previous run, for segments not handed out yet
+    requeues     map[int]uint
     scheduler    workScheduler
     segments     map[int]SegmentResult
     missed       []int
@@ -27,11 +45,51 @@ type SegmentResult struct {
 
 // each worker has it's own queue of segments to download
 func (s *SegmentStatus) CreateQueue(worker int) WorkQueue {
-    return s.scheduler.CreateQueue(worker)
+    return &seededQueue {
+        WorkQueue: s.scheduler.CreateQueue(worker),
+        status:    s,
+    }
+}
+
+// Sets how many times segments were already requeued, such as by a previous
+// run of the download. Segments handed out to workers for the first time
+// start with these counts instead of 0.
+func (s *SegmentStatus) SeedRequeues(requeues map[int]uint) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.requeues = requeues
+}
+
+// takes the seeded requeue count of a segment, it only applies once
+func (s *SegmentStatus) seededRequeues(segment int) uint {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fails, ok := s.requeues[segment]
+    if ok {
+        delete(s.requeues, segment)
+    }
+    return fails
+}
+
+// applies the seeded requeue counts to segments coming out of a scheduler
+type seededQueue struct {
+    WorkQueue
+    status *SegmentStatus
+}
+
+func (q *seededQueue) NextSegment() (int, uint, bool) {
+    seg, fails, ok := q.WorkQueue.NextSegment()
+    if ok && fails == 0 {
+        fails = q.status.seededRequeues(seg)
+    }
+    return seg, fails, ok
 }
 
 func (s *SegmentStatus) IsLast(segment int) bool {
-    return segment == s.end - 1
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    //while live, the newest segment will be followed by more
+    return s.ended && segment == s.end - 1
 }
 
 func (s *SegmentStatus) MissedSegments() []int {
@@ -39,25 +97,162 @@ func (s *SegmentStatus) MissedSegments() []int {
 }
 
 func (s *SegmentStatus) Total() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
     return s.end
 }
 
+// grows the amount of segments of a live status. shrinking is not supported.
+func (s *SegmentStatus) Extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ended || end <= s.end {
+        return
+    }
+    s.end = end
+    s.scheduler.extend(end)
+    s.notify()
+}
+
+// no more segments will be added to a live status, workers exit once
+// there's nothing left to download
+func (s *SegmentStatus) EndLive() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ended {
+        return
+    }
+    s.ended = true
+    s.scheduler.finish()
+    s.notify()
+}
+
+// stops handing out segments to workers and makes Done return true, so
+// downloading and merging stop early
+func (s *SegmentStatus) Cancel() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.cancelled {
+        return
+    }
+    s.cancelled = true
+    s.ended = true
+    s.scheduler.cancel()
+    s.notify()
+}
+
+func (s *SegmentStatus) Cancelled() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.cancelled
+}
+
+func (s *SegmentStatus) Ended() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.ended
+}
+
+// Limits how many segments past the merge position are handed out to
+// workers, 0 for no limit. Only QueueMergeAware supports it, other modes
+// ignore it.
+func (s *SegmentStatus) SetMergeWindow(window int) {
+    if f, ok := s.scheduler.(mergeFollower); ok {
+        f.setWindow(window)
+    }
+}
+
+// Pauses handing out segments past the merge position while the budget is
+// exceeded, until the merger deletes enough of them. Only QueueMergeAware
+// supports it, other modes ignore it.
+func (s *SegmentStatus) SetTempBudget(budget *util.DiskBudget) {
+    if f, ok := s.scheduler.(mergeFollower); ok {
+        f.setBudget(budget)
+    }
+}
+
+//must be called with the lock held
+func (s *SegmentStatus) notify() {
+    close(s.changed)
+    s.changed = make(chan struct{})
+}
+
+// Returns a channel that gets closed the next time a segment is downloaded,
+// or the status is extended, ended or cancelled. Get it before checking the
+// status to not miss changes made in between.
+func (s *SegmentStatus) Changed() <-chan struct{} {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.changed
+}
+
 // retrieves the next segment to be merged, if available
 // and advances the merge position (so the next call will attempt
 // to fetch the next segment)
 func (s *SegmentStatus) NextToMerge() (SegmentResult, int, bool) {
     s.mu.Lock()
     defer s.mu.Unlock()
+    return s.nextToMerge()
+}
+
+// Waits until the next segment to be merged is downloaded, then advances
+// the merge position like NextToMerge. waiting is called with the segment
+// number if it isn't ready yet, and may be nil. Returns false once every
+// segment was merged or the status was cancelled.
+func (s *SegmentStatus) WaitNextToMerge(waiting func(int)) (SegmentResult, int, bool) {
+    for first := true; ; first = false {
+        s.mu.Lock()
+        if s.cancelled || (s.ended && s.mergedCount >= s.end) {
+            s.mu.Unlock()
+            return SegmentResult {}, -1, false
+        }
+        r, number, ok := s.nextToMerge()
+        changed := s.changed
+        s.mu.Unlock()
+        if ok {
+            return r, number, true
+        }
 
+        if first && waiting != nil {
+            waiting(number)
+        }
+        <-changed
+    }
+}
+
+//must be called with the lock held
+func (s *SegmentStatus) nextToMerge() (SegmentResult, int, bool) {
     number := s.mergedCount
     r, ok := s.segments[number]
     if ok {
         delete(s.segments, number)
         s.mergedCount++
+        if f, ok := s.scheduler.(mergeFollower); ok {
+            f.mergedUpTo(s.mergedCount)
+        }
     }
     return r, number, ok
 }
 
+// whether a segment was downloaded successfully, and whether that's known
+// yet. also works for segments that were already merged.
+func (s *SegmentStatus) Lookup(number int) (bool, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if r, ok := s.segments[number]; ok {
+        return r.Ok, true
+    }
+    if number >= s.mergedCount {
+        return false, false
+    }
+    for _, v := range s.missed {
+        if v == number {
+            return false, true
+        }
+    }
+    return true, true
+}
+
 // download task done downloading a segment
 func (s *SegmentStatus) Downloaded(number int, result SegmentResult) {
     s.mu.Lock()
@@ -66,26 +261,31 @@ func (s *SegmentStatus) Downloaded(number int, result SegmentResult) {
         s.missed = append(s.missed, number)
     }
     s.segments[number] = result
+    s.notify()
 }
 
 // are all segments merged?
 func (s *SegmentStatus) Done() bool {
     s.mu.Lock()
     defer s.mu.Unlock()
-    return s.mergedCount == s.end
+    return s.cancelled || (s.ended && s.mergedCount == s.end)
 }
 
-func Create(segmentCount int, threads int, mode QueueMode, requeueDelay time.Duration) *SegmentStatus {
+func create(segmentCount int, threads int, mode QueueMode, requeueDelay time.Duration, live bool) *SegmentStatus {
     var scheduler workScheduler
     switch mode {
     case QueueOutOfOrder:
-        scheduler = makeBatchedScheduler(segmentCount, requeueDelay, threads)
+        scheduler = makeBatchedScheduler(segmentCount, requeueDelay, threads, live)
     case QueueSequential:
-        scheduler = makeSequentialScheduler(segmentCount, requeueDelay)
+        scheduler = makeSequentialScheduler(segmentCount, requeueDelay, live)
+    case QueueMergeAware:
+        scheduler = makeMergeAwareScheduler(segmentCount, requeueDelay, live)
     }
 
     ret := &SegmentStatus {
+        changed:     make(chan struct{}),
         end:         segmentCount,
+        ended:       !live,
         mergedCount: 0,
         scheduler:   scheduler,
         segments:    make(map[int]SegmentResult),
@@ -94,3 +294,12 @@ func Create(segmentCount int, threads int, mode QueueMode, requeueDelay time.Dur
     return ret
 }
 
+func Create(segmentCount int, threads int, mode QueueMode, requeueDelay time.Duration) *SegmentStatus {
+    return create(segmentCount, threads, mode, requeueDelay, false)
+}
+
+// creates a status for a stream that's still live. more segments can be
+// added with Extend until EndLive is called.
+func CreateLive(segmentCount int, threads int, mode QueueMode, requeueDelay time.Duration) *SegmentStatus {
+    return create(segmentCount, threads, mode, requeueDelay, true)
+}
@@ -0,0 +1,133 @@
+package segments
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSeedRequeues(t *testing.T) {
+    s := Create(3, 1, QueueSequential, 0)
+    s.SeedRequeues(map[int]uint { 1: 2 })
+    q := s.CreateQueue(0)
+
+    expected := []uint { 0, 2, 0 }
+    for i, want := range expected {
+        seg, fails, ok := q.NextSegment()
+        if !ok || seg != i {
+            t.Fatalf("Expected segment %d, got %d (ok: %v)", i, seg, ok)
+        }
+        if fails != want {
+            t.Errorf("Segment %d has %d requeues, expected %d", seg, fails, want)
+        }
+    }
+
+    //counts from this run win over the seeded ones
+    q.RequeueFailed(1, 3)
+    seg, fails, ok := q.NextSegment()
+    if !ok || seg != 1 || fails != 3 {
+        t.Errorf("Expected segment 1 with 3 requeues, got %d with %d (ok: %v)", seg, fails, ok)
+    }
+}
+
+func TestWaitNextToMerge(t *testing.T) {
+    s := Create(2, 1, QueueSequential, 0)
+    s.Downloaded(1, SegmentResult { Filename: "b", Ok: true })
+    s.Downloaded(0, SegmentResult { Filename: "a", Ok: true })
+
+    //merged in order, whatever order they were downloaded in
+    for i, name := range []string { "a", "b" } {
+        r, number, ok := s.WaitNextToMerge(nil)
+        if !ok || number != i || r.Filename != name {
+            t.Fatalf("Expected segment %d (%s), got %d (%s, ok: %v)", i, name, number, r.Filename, ok)
+        }
+    }
+    if _, _, ok := s.WaitNextToMerge(nil); ok {
+        t.Error("Got a segment after every segment was merged")
+    }
+    if !s.Done() {
+        t.Error("Status isn't done after merging every segment")
+    }
+}
+
+type mergeResult struct {
+    number int
+    ok     bool
+}
+
+// waits for the next segment to merge in the background
+func waitNextAsync(s *SegmentStatus, waiting func(int)) <-chan mergeResult {
+    c := make(chan mergeResult, 1)
+    go func() {
+        _, number, ok := s.WaitNextToMerge(waiting)
+        c <- mergeResult { number, ok }
+    }()
+    return c
+}
+
+func expectWaiting(t *testing.T, c <-chan mergeResult) {
+    t.Helper()
+    select {
+    case r := <-c:
+        t.Fatalf("Expected the merger to keep waiting, got segment %d (ok: %v)", r.number, r.ok)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func expectWokenUp(t *testing.T, c <-chan mergeResult, number int, ok bool) {
+    t.Helper()
+    select {
+    case r := <-c:
+        if r.number != number || r.ok != ok {
+            t.Fatalf("Expected segment %d (ok: %v), got %d (ok: %v)", number, ok, r.number, r.ok)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Merger wasn't woken up")
+    }
+}
+
+func TestWaitNextToMergeWakesOnDownload(t *testing.T) {
+    s := Create(3, 1, QueueSequential, 0)
+    waitedFor := make(chan int, 1)
+    pending := waitNextAsync(s, func(number int) {
+        waitedFor <- number
+    })
+    expectWaiting(t, pending)
+    if number := <-waitedFor; number != 0 {
+        t.Errorf("Merger reported waiting for segment %d, expected 0", number)
+    }
+
+    //not the one the merger waits for
+    s.Downloaded(1, SegmentResult { Filename: "b", Ok: true })
+    expectWaiting(t, pending)
+    s.Downloaded(0, SegmentResult { Filename: "a", Ok: true })
+    expectWokenUp(t, pending, 0, true)
+    //already downloaded, no need to wait
+    expectWokenUp(t, waitNextAsync(s, nil), 1, true)
+}
+
+func TestWaitNextToMergeWakesOnCancel(t *testing.T) {
+    s := Create(3, 1, QueueSequential, 0)
+    pending := waitNextAsync(s, nil)
+    expectWaiting(t, pending)
+    s.Cancel()
+    expectWokenUp(t, pending, -1, false)
+}
+
+func TestWaitNextToMergeWakesOnEndLive(t *testing.T) {
+    s := CreateLive(1, 1, QueueSequential, 0)
+    s.Downloaded(0, SegmentResult { Filename: "a", Ok: true })
+    expectWokenUp(t, waitNextAsync(s, nil), 0, true)
+
+    //more segments might show up while live
+    pending := waitNextAsync(s, nil)
+    expectWaiting(t, pending)
+    s.Extend(2)
+    expectWaiting(t, pending)
+    s.Downloaded(1, SegmentResult { Filename: "b", Ok: true })
+    expectWokenUp(t, pending, 1, true)
+
+    pending = waitNextAsync(s, nil)
+    expectWaiting(t, pending)
+    s.EndLive()
+    expectWokenUp(t, pending, -1, false)
+}
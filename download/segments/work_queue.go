@@ -2,10 +2,12 @@ package segments
 
 import (
     "fmt"
+    "sort"
     "sync"
     "time"
 
     "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
 type failedSeg struct {
@@ -18,12 +20,20 @@ func (f failedSeg) isReady() bool {
     return time.Now().After(f.timestamp)
 }
 
-func (f failedSeg) wait() {
+// returns false if the scheduler got cancelled while waiting
+func (f failedSeg) wait(cancelled <-chan struct{}) bool {
     delay := f.timestamp.Sub(time.Now())
     if delay.Seconds() > 1 {
         log.Debugf("Waiting %v before retrying segment %d", delay.Round(time.Second), f.seg)
     }
-    time.Sleep(delay)
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-cancelled:
+        return false
+    }
 }
 
 func makeFailedSeg(seg int, fails uint, delay time.Duration) failedSeg {
@@ -41,24 +51,77 @@ type WorkQueue interface {
 
 type workScheduler interface {
     CreateQueue(worker int) WorkQueue
+    // adds segments up to (not including) end, for live streams
+    extend(end int)
+    // no more segments will be added, wakes up waiting workers
+    finish()
+    // stops handing out segments, even if some are left
+    cancel()
+}
+
+// implemented by schedulers that follow the merge position
+type mergeFollower interface {
+    // count segments have been merged
+    mergedUpTo(count int)
+    // how many segments past the merge position can be handed out, 0 for
+    // no limit
+    setWindow(window int)
+    // only the segment the merger waits for is handed out while the budget
+    // is exceeded
+    setBudget(budget *util.DiskBudget)
 }
 
 // Simple, sequential scheduler. Workers get the next segment from a shared counter
 var _ workScheduler = &sequentialScheduler {}
 type sequentialScheduler struct {
     mu           sync.Mutex
+    cond         *sync.Cond
+    cancelled    chan struct{}
+    ended        bool
     max          int
     next         int
     failed       []failedSeg
     requeueDelay time.Duration
 }
 
-func makeSequentialScheduler(totalSegments int, requeueDelay time.Duration) workScheduler {
-    return &sequentialScheduler {
+func makeSequentialScheduler(totalSegments int, requeueDelay time.Duration, live bool) workScheduler {
+    s := &sequentialScheduler {
+        cancelled:    make(chan struct{}),
+        ended:        !live,
         max:          totalSegments,
         next:         0,
         requeueDelay: requeueDelay,
     }
+    s.cond = sync.NewCond(&s.mu)
+    return s
+}
+
+func (s *sequentialScheduler) extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if end > s.max {
+        s.max = end
+        s.cond.Broadcast()
+    }
+}
+
+func (s *sequentialScheduler) finish() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.ended = true
+    s.cond.Broadcast()
+}
+
+func (s *sequentialScheduler) cancel() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    select {
+    case <-s.cancelled:
+    default:
+        close(s.cancelled)
+    }
+    s.ended = true
+    s.cond.Broadcast()
 }
 
 func (s *sequentialScheduler) CreateQueue(_ int) WorkQueue {
@@ -74,19 +137,31 @@ func (s *sequentialQueue) nextInternal() (failedSeg, int, bool) {
     s.sched.mu.Lock()
     defer s.sched.mu.Unlock()
 
-    if s.sched.next < s.sched.max {
-        seg := s.sched.next
-        s.sched.next++
-        return failedSeg{}, seg, true
-    }
+    for {
+        select {
+        case <-s.sched.cancelled:
+            return failedSeg{}, 0, false
+        default:
+        }
 
-    if len(s.sched.failed) > 0 {
-        seg := s.sched.failed[0]
-        s.sched.failed = s.sched.failed[1:]
-        return seg, -1, true
-    }
+        if s.sched.next < s.sched.max {
+            seg := s.sched.next
+            s.sched.next++
+            return failedSeg{}, seg, true
+        }
+
+        if len(s.sched.failed) > 0 {
+            seg := s.sched.failed[0]
+            s.sched.failed = s.sched.failed[1:]
+            return seg, -1, true
+        }
 
-    return failedSeg{}, 0, false
+        if s.sched.ended {
+            return failedSeg{}, 0, false
+        }
+        //live stream, wait for new segments to show up
+        s.sched.cond.Wait()
+    }
 }
 
 func (s *sequentialQueue) NextSegment() (int, uint, bool) {
@@ -98,7 +173,9 @@ func (s *sequentialQueue) NextSegment() (int, uint, bool) {
     if seg >= 0 {
         return seg, 0, true
     }
-    f.wait()
+    if !f.wait(s.sched.cancelled) {
+        return -1, 0, false
+    }
     return f.seg, f.fails, true
 }
 
@@ -107,21 +184,233 @@ func (s *sequentialQueue) RequeueFailed(seg int, fails uint) {
     defer s.sched.mu.Unlock()
 
     s.sched.failed = append(s.sched.failed, makeFailedSeg(seg, fails, s.sched.requeueDelay))
+    s.sched.cond.Broadcast()
+}
+
+// Hands out segments in order like the sequential scheduler, but keeps track
+// of the merge position. Requeued segments are retried before new ones, the
+// ones closest to the merge position first, since the merger is most likely
+// stuck on them. Segments too far past the merge position, or any past it
+// while the temp budget is exceeded, aren't handed out until the merger
+// catches up, which bounds how many downloaded segments wait on disk.
+var _ workScheduler = &mergeAwareScheduler {}
+var _ mergeFollower = &mergeAwareScheduler {}
+type mergeAwareScheduler struct {
+    mu           sync.Mutex
+    budget       *util.DiskBudget
+    cancelled    chan struct{}
+    // closed and replaced whenever waiting workers should look again
+    changed      chan struct{}
+    ended        bool
+    max          int
+    next         int
+    mergedCount  int
+    window       int
+    // sorted by segment number
+    failed       []failedSeg
+    requeueDelay time.Duration
+}
+
+func makeMergeAwareScheduler(totalSegments int, requeueDelay time.Duration, live bool) workScheduler {
+    return &mergeAwareScheduler {
+        cancelled:    make(chan struct{}),
+        changed:      make(chan struct{}),
+        ended:        !live,
+        max:          totalSegments,
+        requeueDelay: requeueDelay,
+    }
+}
+
+//requires lock to be held before calling
+func (s *mergeAwareScheduler) notify() {
+    close(s.changed)
+    s.changed = make(chan struct{})
+}
+
+func (s *mergeAwareScheduler) extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if end > s.max {
+        s.max = end
+        s.notify()
+    }
+}
+
+func (s *mergeAwareScheduler) finish() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.ended = true
+    s.notify()
+}
+
+func (s *mergeAwareScheduler) cancel() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    select {
+    case <-s.cancelled:
+    default:
+        close(s.cancelled)
+    }
+    s.ended = true
+    s.notify()
+}
+
+func (s *mergeAwareScheduler) mergedUpTo(count int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if count > s.mergedCount {
+        s.mergedCount = count
+        s.notify()
+    }
+}
+
+func (s *mergeAwareScheduler) setWindow(window int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.window = window
+    s.notify()
+}
+
+func (s *mergeAwareScheduler) setBudget(budget *util.DiskBudget) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.budget = budget
+    s.notify()
+}
+
+//requires lock to be held before calling
+func (s *mergeAwareScheduler) canStart(seg int) bool {
+    if s.window > 0 && seg >= s.mergedCount + s.window {
+        return false
+    }
+    //the segment the merger waits for always gets downloaded, nothing
+    //would free space otherwise
+    return seg <= s.mergedCount || !s.budget.Exceeded()
+}
+
+func (s *mergeAwareScheduler) CreateQueue(_ int) WorkQueue {
+    return &mergeAwareQueue { sched: s }
+}
+
+var _ WorkQueue = &mergeAwareQueue {}
+type mergeAwareQueue struct {
+    sched *mergeAwareScheduler
+}
+
+func (q *mergeAwareQueue) nextInternal() (failedSeg, int, bool) {
+    s := q.sched
+    for {
+        s.mu.Lock()
+        //get it before checking the budget, so space freed in between
+        //isn't missed
+        freed := s.budget.Changed()
+
+        select {
+        case <-s.cancelled:
+            s.mu.Unlock()
+            return failedSeg{}, 0, false
+        default:
+        }
+
+        for i, f := range s.failed {
+            if f.isReady() {
+                s.failed = append(s.failed[:i], s.failed[i + 1:]...)
+                s.mu.Unlock()
+                return f, -1, true
+            }
+        }
+
+        if s.next < s.max && s.canStart(s.next) {
+            seg := s.next
+            s.next++
+            s.mu.Unlock()
+            return failedSeg{}, seg, true
+        }
+
+        //nothing else to do, wait for the requeued segment closest to
+        //the merge position
+        if len(s.failed) > 0 {
+            f := s.failed[0]
+            s.failed = s.failed[1:]
+            s.mu.Unlock()
+            return f, -1, true
+        }
+
+        if s.ended && s.next >= s.max {
+            s.mu.Unlock()
+            return failedSeg{}, 0, false
+        }
+        //wait for the merger to catch up, space to be freed or new
+        //segments of a live stream to show up
+        changed := s.changed
+        s.mu.Unlock()
+        select {
+        case <-changed:
+        case <-freed:
+        case <-s.cancelled:
+        }
+    }
+}
+
+func (q *mergeAwareQueue) NextSegment() (int, uint, bool) {
+    //don't hold lock while waiting for a failed segment
+    f, seg, ok := q.nextInternal()
+    if !ok {
+        return -1, 0, false
+    }
+    if seg >= 0 {
+        return seg, 0, true
+    }
+    if !f.wait(q.sched.cancelled) {
+        return -1, 0, false
+    }
+    return f.seg, f.fails, true
+}
+
+func (q *mergeAwareQueue) RequeueFailed(seg int, fails uint) {
+    s := q.sched
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    i := sort.Search(len(s.failed), func(i int) bool {
+        return s.failed[i].seg > seg
+    })
+    s.failed = append(s.failed, failedSeg{})
+    copy(s.failed[i + 1:], s.failed[i:])
+    s.failed[i] = makeFailedSeg(seg, fails, s.requeueDelay)
+    s.notify()
 }
 
 // Splits the work in batches, each worker goes through it's own batch, but if it's
 // done it can steal from other workers.
 var _ workScheduler = &batchedScheduler {}
+//
+// Segments added to live streams after creation are handed out sequentially
+// once a worker runs out of segments to steal.
 type batchedScheduler struct {
     batches      []*batchRange
     requeueDelay time.Duration
+    // protects the fields below
+    mu           sync.Mutex
+    cond         *sync.Cond
+    cancelled    chan struct{}
+    ended        bool
+    // bumped whenever work is added, so workers don't miss wakeups
+    generation   uint64
+    tailNext     int
+    tailEnd      int
 }
 
-func makeBatchedScheduler(segments int, requeueDelay time.Duration, threads int) workScheduler {
+func makeBatchedScheduler(segments int, requeueDelay time.Duration, threads int, live bool) workScheduler {
     s := &batchedScheduler {
         batches:      make([]*batchRange, 0),
         requeueDelay: requeueDelay,
+        cancelled:    make(chan struct{}),
+        ended:        !live,
+        tailNext:     segments,
+        tailEnd:      segments,
     }
+    s.cond = sync.NewCond(&s.mu)
     lastSeg := -1
     interval := segments / threads
     for {
@@ -155,6 +444,44 @@ func makeBatchedScheduler(segments int, requeueDelay time.Duration, threads int)
     return s
 }
 
+func (s *batchedScheduler) extend(end int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if end > s.tailEnd {
+        s.tailEnd = end
+        s.generation++
+        s.cond.Broadcast()
+    }
+}
+
+func (s *batchedScheduler) finish() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.ended = true
+    s.generation++
+    s.cond.Broadcast()
+}
+
+func (s *batchedScheduler) cancel() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    select {
+    case <-s.cancelled:
+    default:
+        close(s.cancelled)
+    }
+    s.ended = true
+    s.generation++
+    s.cond.Broadcast()
+}
+
+func (s *batchedScheduler) workAdded() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.generation++
+    s.cond.Broadcast()
+}
+
 func (s *batchedScheduler) CreateQueue(worker int) WorkQueue {
     if worker < 0 || worker >= len(s.batches) {
         panic(fmt.Sprintf("Invalid worker number %d (worker count: %d)", worker, len(s.batches)))
@@ -226,19 +553,48 @@ func (b *batchRange) trySteal() (failedSeg, int, bool) {
 }
 
 func (b *batchRange) nextInternal() (failedSeg, int, bool) {
-    f, seg, ok := b.tryGetNext()
-    if ok {
-        return f, seg, true
-    }
-    for _, v := range b.sched.batches {
-        if v != b {
-            f, seg, ok = v.trySteal()
-            if ok {
-                return f, seg, true
+    for {
+        b.sched.mu.Lock()
+        generation := b.sched.generation
+        b.sched.mu.Unlock()
+
+        select {
+        case <-b.sched.cancelled:
+            return failedSeg {}, -1, false
+        default:
+        }
+
+        f, seg, ok := b.tryGetNext()
+        if ok {
+            return f, seg, true
+        }
+        for _, v := range b.sched.batches {
+            if v != b {
+                f, seg, ok = v.trySteal()
+                if ok {
+                    return f, seg, true
+                }
             }
         }
+
+        b.sched.mu.Lock()
+        if b.sched.tailNext < b.sched.tailEnd {
+            seg = b.sched.tailNext
+            b.sched.tailNext++
+            b.sched.mu.Unlock()
+            return failedSeg {}, seg, true
+        }
+        if b.sched.ended {
+            b.sched.mu.Unlock()
+            return failedSeg {}, -1, false
+        }
+        //live stream, wait for new segments unless something got
+        //requeued while we were looking
+        if generation == b.sched.generation {
+            b.sched.cond.Wait()
+        }
+        b.sched.mu.Unlock()
     }
-    return failedSeg {}, -1, false
 }
 
 func (b *batchRange) NextSegment() (int, uint, bool) {
@@ -250,14 +606,17 @@ func (b *batchRange) NextSegment() (int, uint, bool) {
     if seg >= 0 {
         return seg, 0, true
     }
-    f.wait()
+    if !f.wait(b.sched.cancelled) {
+        return -1, 0, false
+    }
     return f.seg, f.fails, true
 }
 
 func (b *batchRange) RequeueFailed(seg int, fails uint) {
     b.mu.Lock()
-    defer b.mu.Unlock()
-
     b.failed = append(b.failed, makeFailedSeg(seg, fails, b.sched.requeueDelay))
+    b.mu.Unlock()
+
+    b.sched.workAdded()
 }
 
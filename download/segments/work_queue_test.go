@@ -0,0 +1,215 @@
+package segments
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "sort"
+    "testing"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+type nextResult struct {
+    seg int
+    ok  bool
+}
+
+// asks the queue for a segment in the background
+func nextAsync(q WorkQueue) <-chan nextResult {
+    c := make(chan nextResult, 1)
+    go func() {
+        seg, _, ok := q.NextSegment()
+        c <- nextResult { seg, ok }
+    }()
+    return c
+}
+
+// waits for a segment asked for with nextAsync
+func await(t *testing.T, c <-chan nextResult) nextResult {
+    t.Helper()
+    select {
+    case r := <-c:
+        return r
+    case <-time.After(time.Second):
+        t.Fatal("Queue blocked")
+        return nextResult {}
+    }
+}
+
+func expectBlocked(t *testing.T, c <-chan nextResult) {
+    t.Helper()
+    select {
+    case r := <-c:
+        t.Fatalf("Expected the queue to block, got segment %d (ok: %v)", r.seg, r.ok)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func next(t *testing.T, q WorkQueue) int {
+    t.Helper()
+    r := await(t, nextAsync(q))
+    if !r.ok {
+        t.Fatal("Queue is done, expected a segment")
+    }
+    return r.seg
+}
+
+// returns the segments handed out until the queue is done
+func drain(t *testing.T, q WorkQueue) []int {
+    t.Helper()
+    var got []int
+    for {
+        r := await(t, nextAsync(q))
+        if !r.ok {
+            return got
+        }
+        got = append(got, r.seg)
+    }
+}
+
+func expectSegments(t *testing.T, got []int, expected ...int) {
+    t.Helper()
+    if len(got) != len(expected) {
+        t.Fatalf("Expected segments %v, got %v", expected, got)
+    }
+    for i := range got {
+        if got[i] != expected[i] {
+            t.Fatalf("Expected segments %v, got %v", expected, got)
+        }
+    }
+}
+
+func TestSequentialScheduler(t *testing.T) {
+    s := makeSequentialScheduler(5, 0, false)
+    q := s.CreateQueue(0)
+    other := s.CreateQueue(1)
+    for i := 0; i < 3; i++ {
+        if seg, _, ok := q.NextSegment(); !ok || seg != i {
+            t.Fatalf("Expected segment %d, got %d (ok: %v)", i, seg, ok)
+        }
+    }
+    //queues share the counter and the requeued segments
+    q.RequeueFailed(1, 1)
+    if seg, _, ok := other.NextSegment(); !ok || seg != 3 {
+        t.Fatalf("Expected segment 3, got %d (ok: %v)", seg, ok)
+    }
+    expectSegments(t, drain(t, other), 4, 1)
+}
+
+func TestSequentialSchedulerLive(t *testing.T) {
+    s := makeSequentialScheduler(2, 0, true)
+    q := s.CreateQueue(0)
+    expectSegments(t, []int { next(t, q), next(t, q) }, 0, 1)
+    pending := nextAsync(q)
+    expectBlocked(t, pending)
+    s.extend(4)
+    expectSegments(t, []int { await(t, pending).seg, next(t, q) }, 2, 3)
+    s.finish()
+    expectSegments(t, drain(t, q))
+}
+
+func TestBatchedScheduler(t *testing.T) {
+    s := makeBatchedScheduler(10, 0, 3, false)
+    queues := []WorkQueue { s.CreateQueue(0), s.CreateQueue(1), s.CreateQueue(2) }
+    if seg := next(t, queues[1]); seg != 4 {
+        t.Fatalf("Expected the second batch to start at segment 4, got %d", seg)
+    }
+    //steals the rest from the other batches, from their ends
+    got := drain(t, queues[0])
+    sort.Ints(got)
+    expectSegments(t, got, 0, 1, 2, 3, 5, 6, 7, 8, 9)
+
+    queues[2].RequeueFailed(7, 1)
+    expectSegments(t, drain(t, queues[1]), 7)
+}
+
+func TestBatchedSchedulerMoreThreads(t *testing.T) {
+    s := makeBatchedScheduler(2, 0, 4, false)
+    var got []int
+    for i := 0; i < 4; i++ {
+        got = append(got, drain(t, s.CreateQueue(i))...)
+    }
+    sort.Ints(got)
+    expectSegments(t, got, 0, 1)
+}
+
+func TestBatchedSchedulerCreateQueueTwice(t *testing.T) {
+    s := makeBatchedScheduler(10, 0, 2, false)
+    s.CreateQueue(0)
+    defer func() {
+        if recover() == nil {
+            t.Error("Creating a queue twice didn't panic")
+        }
+    }()
+    s.CreateQueue(0)
+}
+
+func TestBatchedSchedulerLive(t *testing.T) {
+    s := makeBatchedScheduler(4, 0, 2, true)
+    q := s.CreateQueue(0)
+    s.CreateQueue(1)
+    got := []int { next(t, q), next(t, q), next(t, q), next(t, q) }
+    sort.Ints(got)
+    expectSegments(t, got, 0, 1, 2, 3)
+    s.extend(6)
+    expectSegments(t, []int { next(t, q), next(t, q) }, 4, 5)
+    s.finish()
+    expectSegments(t, drain(t, q))
+}
+
+func TestMergeAwareWindow(t *testing.T) {
+    sched := makeMergeAwareScheduler(20, 50 * time.Millisecond, false)
+    s := sched.(mergeFollower)
+    s.setWindow(3)
+    q := sched.CreateQueue(0)
+    expectSegments(t, []int { next(t, q), next(t, q), next(t, q) }, 0, 1, 2)
+    pending := nextAsync(q)
+    expectBlocked(t, pending)
+    s.mergedUpTo(1)
+    expectSegments(t, []int { await(t, pending).seg }, 3)
+
+    //requeued segments come back closest to the merge position first,
+    //even before new segments
+    q.RequeueFailed(2, 1)
+    q.RequeueFailed(1, 2)
+    seg, fails, ok := q.NextSegment()
+    if !ok || seg != 1 || fails != 2 {
+        t.Fatalf("Expected segment 1 with 2 fails, got %d with %d (ok: %v)", seg, fails, ok)
+    }
+    expectSegments(t, []int { next(t, q) }, 2)
+
+    sched.cancel()
+    if seg, _, ok := q.NextSegment(); ok {
+        t.Fatalf("Got segment %d after cancelling", seg)
+    }
+}
+
+func TestMergeAwareBudget(t *testing.T) {
+    dir := t.TempDir()
+    budget := util.NewDiskBudget(100)
+    sched := makeMergeAwareScheduler(10, 0, false)
+    s := sched.(mergeFollower)
+    s.setBudget(budget)
+    q := sched.CreateQueue(0)
+
+    expectSegments(t, []int { next(t, q), next(t, q) }, 0, 1)
+    file := filepath.Join(dir, "1")
+    if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    budget.Track(file, 100)
+    //only the segment the merger waits for can be handed out now
+    pending := nextAsync(q)
+    expectBlocked(t, pending)
+    q.RequeueFailed(0, 1)
+    expectSegments(t, []int { await(t, pending).seg }, 0)
+
+    pending = nextAsync(q)
+    expectBlocked(t, pending)
+    if err := budget.Remove(file); err != nil {
+        t.Fatal(err)
+    }
+    expectSegments(t, []int { await(t, pending).seg }, 2)
+    expectSegments(t, drain(t, q), 3, 4, 5, 6, 7, 8, 9)
+}
@@ -0,0 +1,136 @@
+package download
+
+import (
+    "net/http"
+    "sync"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+// minimum responses between adjustments of the thread count
+const adaptiveWindow = 20
+
+// Limits how many download threads work at once, lowering the limit when
+// responses show the server is throttling and raising it back when they
+// don't. Threads over the limit wait without holding a segment, so others
+// can take over their work. A nil limiter doesn't limit anything.
+type threadLimiter struct {
+    mu        sync.Mutex
+    cond      *sync.Cond
+    logger    *log.Logger
+    limit     int
+    min       int
+    max       int
+    active    int
+    cancelled bool
+    // responses since the last adjustment
+    ok        int
+    throttled int
+}
+
+func newThreadLimiter(logger *log.Logger, start, min, max int) *threadLimiter {
+    l := &threadLimiter {
+        logger: logger,
+        limit:  start,
+        min:    min,
+        max:    max,
+    }
+    l.cond = sync.NewCond(&l.mu)
+    return l
+}
+
+// waits until the thread can work, returns false if cancelled
+func (l *threadLimiter) acquire() bool {
+    if l == nil {
+        return true
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    for l.active >= l.limit && !l.cancelled {
+        l.cond.Wait()
+    }
+    if l.cancelled {
+        return false
+    }
+    l.active++
+    return true
+}
+
+func (l *threadLimiter) release() {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.active--
+    l.cond.Signal()
+}
+
+// wakes up every waiting thread, acquire fails from now on
+func (l *threadLimiter) cancel() {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.cancelled = true
+    l.cond.Broadcast()
+}
+
+func (l *threadLimiter) current() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.limit
+}
+
+func isThrottled(statusCode int) bool {
+    return statusCode == http.StatusUnauthorized ||
+        statusCode == http.StatusForbidden ||
+        statusCode == http.StatusTooManyRequests
+}
+
+// counts a response to a segment request, adjusting the limit once enough
+// of them were seen
+func (l *threadLimiter) record(statusCode int) {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if isThrottled(statusCode) {
+        l.throttled++
+    } else {
+        l.ok++
+    }
+    total := l.ok + l.throttled
+    //wait for every thread to have made a few requests
+    if total < adaptiveWindow || total < 2 * l.limit {
+        return
+    }
+
+    previous := l.limit
+    switch {
+    case l.throttled * 10 > total:
+        //back off quickly, recover slowly
+        l.limit = l.limit * 2 / 3
+        if l.limit == previous {
+            l.limit--
+        }
+        if l.limit < l.min {
+            l.limit = l.min
+        }
+        if l.limit != previous {
+            l.logger.Warnf("Throttled on %d/%d requests, lowering threads from %d to %d", l.throttled, total, previous, l.limit)
+        }
+    case l.throttled == 0 && l.limit < l.max:
+        l.limit++
+        l.logger.Infof("No throttling on the last %d requests, raising threads to %d", total, l.limit)
+        l.cond.Signal()
+    }
+    l.ok = 0
+    l.throttled = 0
+}
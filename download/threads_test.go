@@ -0,0 +1,87 @@
+package download
+
+import (
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+func recordMany(l *threadLimiter, statusCode int, count int) {
+    for i := 0; i < count; i++ {
+        l.record(statusCode)
+    }
+}
+
+func TestThreadLimiterAdjusts(t *testing.T) {
+    l := newThreadLimiter(log.New("test"), 9, 2, 10)
+
+    //not enough responses to adjust yet
+    recordMany(l, http.StatusTooManyRequests, adaptiveWindow - 1)
+    if limit := l.current(); limit != 9 {
+        t.Fatalf("Limit changed to %d before a full window", limit)
+    }
+    l.record(http.StatusOK)
+    if limit := l.current(); limit != 6 {
+        t.Fatalf("Expected throttling to lower the limit to 6, got %d", limit)
+    }
+
+    //a little throttling keeps the limit where it is
+    recordMany(l, http.StatusOK, adaptiveWindow - 1)
+    l.record(http.StatusForbidden)
+    if limit := l.current(); limit != 6 {
+        t.Fatalf("Expected the limit to stay at 6, got %d", limit)
+    }
+
+    for i := 0; i < 10; i++ {
+        recordMany(l, http.StatusOK, adaptiveWindow)
+    }
+    if limit := l.current(); limit != 10 {
+        t.Fatalf("Expected the limit to be raised up to 10, got %d", limit)
+    }
+
+    for i := 0; i < 10; i++ {
+        recordMany(l, http.StatusUnauthorized, adaptiveWindow)
+    }
+    if limit := l.current(); limit != 2 {
+        t.Fatalf("Expected the limit to be lowered down to 2, got %d", limit)
+    }
+}
+
+func TestThreadLimiterAcquire(t *testing.T) {
+    l := newThreadLimiter(log.New("test"), 1, 1, 1)
+    if !l.acquire() {
+        t.Fatal("Unable to acquire a free thread")
+    }
+
+    acquired := make(chan bool)
+    go func() {
+        acquired <- l.acquire()
+    }()
+    select {
+    case <-acquired:
+        t.Fatal("Acquired a thread over the limit")
+    case <-time.After(50 * time.Millisecond):
+    }
+    l.release()
+    if !<-acquired {
+        t.Fatal("Acquire failed after a thread was released")
+    }
+
+    go func() {
+        acquired <- l.acquire()
+    }()
+    l.cancel()
+    if <-acquired {
+        t.Error("Acquire succeeded after cancelling")
+    }
+    if l.acquire() {
+        t.Error("Acquire succeeded after cancelling")
+    }
+
+    var nilLimiter *threadLimiter
+    if !nilLimiter.acquire() {
+        t.Error("Nil limiter didn't let the thread work")
+    }
+}
@@ -0,0 +1,249 @@
+// End-to-end tests running complete downloads against the fake segment
+// server, with and without injected faults, and checking that the muxed
+// output has everything it should. Scenarios slowed down by retry delays
+// are skipped with -short.
+package e2e
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+    "github.com/HoloArchivists/ytarchive-raw-go/fakeserver"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+type scenario struct {
+    name    string
+    shape   fakeserver.URLShape
+    server  fakeserver.Options
+    // changes to the default job options, may be nil
+    options func(*archive.Options)
+    // segments each track is expected to lose
+    lost    int
+    // extra checks on what the server saw, may be nil
+    check   func(fakeserver.Stats) error
+    // the output only has part of the stream, so its size can't be checked
+    partial bool
+    // takes seconds because of retry delays, skipped with -short
+    slow    bool
+}
+
+var scenarios = []scenario {
+    {
+        name:  "query-urls",
+        shape: fakeserver.URLQuery,
+    },
+    {
+        name:  "path-urls",
+        shape: fakeserver.URLPath,
+    },
+    {
+        name:    "sequential-queue",
+        shape:   fakeserver.URLQuery,
+        options: func(o *archive.Options) {
+            o.QueueMode = segments.QueueSequential
+        },
+    },
+    {
+        name:    "merge-aware-queue",
+        slow:    true,
+        shape:   fakeserver.URLPath,
+        server:  fakeserver.Options {
+            Faults: fakeserver.Faults { Every: 5, Forbidden: 1 },
+        },
+        options: func(o *archive.Options) {
+            o.QueueMode = segments.QueueMergeAware
+            o.MergeWindow = 3
+            o.Threads = 6
+        },
+    },
+    {
+        name:   "forbidden",
+        slow:   true,
+        shape:  fakeserver.URLPath,
+        server: fakeserver.Options {
+            Faults: fakeserver.Faults { Every: 3, Forbidden: 2 },
+        },
+        check:  func(s fakeserver.Stats) error {
+            if s.Forbidden == 0 {
+                return fmt.Errorf("No 403 responses were sent")
+            }
+            return nil
+        },
+    },
+    {
+        name:   "truncated",
+        slow:   true,
+        shape:  fakeserver.URLQuery,
+        server: fakeserver.Options {
+            Faults: fakeserver.Faults { Every: 2, Truncated: 1 },
+        },
+        check:  func(s fakeserver.Stats) error {
+            if s.Truncated == 0 {
+                return fmt.Errorf("No truncated responses were sent")
+            }
+            if s.Ranged == 0 {
+                return fmt.Errorf("Truncated segments weren't resumed")
+            }
+            return nil
+        },
+    },
+    {
+        name:    "slow",
+        shape:   fakeserver.URLQuery,
+        server:  fakeserver.Options {
+            Faults: fakeserver.Faults { Delay: 200 * time.Millisecond },
+        },
+        options: func(o *archive.Options) {
+            o.Threads = 8
+        },
+    },
+    {
+        name:   "missing-last",
+        slow:   true,
+        shape:  fakeserver.URLPath,
+        server: fakeserver.Options {
+            Faults: fakeserver.Faults { MissingLast: 2 },
+        },
+        lost:   2,
+    },
+    {
+        name:    "injected-faults",
+        slow:    true,
+        shape:   fakeserver.URLPath,
+        options: func(o *archive.Options) {
+            o.FailThreshold = 10
+            o.Client = util.NewClient(&util.HttpClientConfig {
+                Middleware: []util.Middleware {
+                    util.FaultInjector(&util.Faults {
+                        LatencyRate:  0.2,
+                        Latency:      300 * time.Millisecond,
+                        ResetRate:    0.1,
+                        StatusRate:   0.1,
+                        Statuses:     []int { 403, 503 },
+                        TruncateRate: 0.1,
+                    }),
+                },
+            })
+        },
+    },
+    {
+        name:    "temp-budget",
+        shape:   fakeserver.URLQuery,
+        server:  fakeserver.Options {
+            Faults: fakeserver.Faults { Delay: 20 * time.Millisecond },
+        },
+        options: func(o *archive.Options) {
+            o.TempBudget = util.NewDiskBudget(32 * 1024)
+            o.Threads = 8
+        },
+    },
+    {
+        //partial downloads kept for resuming count against the budget
+        //until they're renamed
+        name:    "temp-budget-truncated",
+        slow:    true,
+        shape:   fakeserver.URLPath,
+        server:  fakeserver.Options {
+            Faults: fakeserver.Faults { Every: 2, Truncated: 1 },
+        },
+        options: func(o *archive.Options) {
+            o.TempBudget = util.NewDiskBudget(32 * 1024)
+        },
+        check:   func(s fakeserver.Stats) error {
+            if s.Ranged == 0 {
+                return fmt.Errorf("Truncated segments weren't resumed")
+            }
+            return nil
+        },
+    },
+    {
+        name:    "clip",
+        shape:   fakeserver.URLQuery,
+        options: func(o *archive.Options) {
+            o.StartTime = 5 * time.Second
+            o.EndTime = 12 * time.Second
+        },
+        partial: true,
+    },
+}
+
+func run(s scenario, dir string) error {
+    server := fakeserver.New(s.server)
+    defer server.Close()
+
+    opts := archive.Options {
+        Client:         util.NewClient(&util.HttpClientConfig {}),
+        FailThreshold:  3,
+        Merger:         "native",
+        Output:         filepath.Join(dir, "%(id)s"),
+        RequeueDelay:   100 * time.Millisecond,
+        RetryThreshold: 1,
+        TempDir:        filepath.Join(dir, "temp"),
+        Threads:        4,
+    }
+    if s.options != nil {
+        s.options(&opts)
+    }
+
+    res, err := archive.NewJob(server.FregData(s.shape), opts).Run(context.Background())
+    if err != nil {
+        return err
+    }
+    if lost := len(res.Audio.LostSegments); lost != s.lost {
+        return fmt.Errorf("Lost %d audio segments, expected %d", lost, s.lost)
+    }
+    if lost := len(res.Video.LostSegments); lost != s.lost {
+        return fmt.Errorf("Lost %d video segments, expected %d", lost, s.lost)
+    }
+
+    info, err := os.Stat(res.Output)
+    if err != nil {
+        return fmt.Errorf("Unable to find output: %v", err)
+    }
+    expected := server.MediaBytes(fakeserver.AudioItag) + server.MediaBytes(fakeserver.VideoItag)
+    if !s.partial && info.Size() < expected {
+        return fmt.Errorf("Output has %d bytes, expected at least %d of media data", info.Size(), expected)
+    }
+    if s.partial && info.Size() >= expected {
+        return fmt.Errorf("Output has %d bytes, expected less than %d", info.Size(), expected)
+    }
+
+    //every segment should have been deleted once merged
+    if used := opts.TempBudget.Used(); used != 0 {
+        return fmt.Errorf("%d bytes of segments are still counted against the temp budget", used)
+    }
+
+    if s.check != nil {
+        return s.check(server.Stats())
+    }
+    return nil
+}
+
+func TestMain(m *testing.M) {
+    log.DisableProgress()
+    log.SetDefaultLevel(log.LevelFatal)
+    os.Exit(m.Run())
+}
+
+func TestScenarios(t *testing.T) {
+    for _, s := range scenarios {
+        s := s
+        t.Run(s.name, func(t *testing.T) {
+            if s.slow && testing.Short() {
+                t.Skip("Slow scenario")
+            }
+            t.Parallel()
+            if err := run(s, t.TempDir()); err != nil {
+                t.Fatal(err)
+            }
+        })
+    }
+}
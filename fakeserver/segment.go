@@ -0,0 +1,139 @@
+package fakeserver
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+)
+
+// every track uses milliseconds as its timescale
+const timescale = 1000
+
+type trackKind struct {
+    audio         bool
+    // duration of every frame, in milliseconds
+    frameDuration uint32
+    frameSize     int
+}
+
+var (
+    audioKind = trackKind {
+        audio:         true,
+        frameDuration: 20,
+        frameSize:     64,
+    }
+    videoKind = trackKind {
+        frameDuration: 100,
+        frameSize:     1024,
+    }
+)
+
+func (k trackKind) frames(segmentDuration uint32) int {
+    return int(segmentDuration / k.frameDuration)
+}
+
+// bytes of media data in a segment, without the containing boxes
+func (k trackKind) mediaBytes(segmentDuration uint32) int {
+    return k.frames(segmentDuration) * k.frameSize
+}
+
+func box(typ string, parts ...[]byte) []byte {
+    body := bytes.Join(parts, nil)
+    out := make([]byte, 8, 8 + len(body))
+    binary.BigEndian.PutUint32(out, uint32(8 + len(body)))
+    copy(out[4:], typ)
+    return append(out, body...)
+}
+
+func u16(v uint16) []byte {
+    return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+    return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+    return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func zeros(n int) []byte {
+    return make([]byte, n)
+}
+
+func (k trackKind) sampleEntry() []byte {
+    if k.audio {
+        //AAC LC, 44.1kHz, stereo
+        esds := box("esds",
+            u32(0),
+            []byte { 0x03, 25, 0, 1, 0 },
+            []byte { 0x04, 17, 0x40, 0x15 }, zeros(11),
+            []byte { 0x05, 2, 0x12, 0x10 },
+            []byte { 0x06, 1, 0x02 },
+        )
+        return box("mp4a",
+            zeros(6), u16(1),
+            zeros(8), u16(2), u16(16), zeros(4), u32(44100 << 16),
+            esds,
+        )
+    }
+    avcC := box("avcC", []byte { 1, 0x64, 0, 0x1f, 0xff, 0xe0, 0x01 })
+    return box("avc1",
+        zeros(6), u16(1),
+        zeros(16), u16(1920), u16(1080), u32(0x480000), u32(0x480000), zeros(4), u16(1), zeros(32), u16(0x18), u16(0xffff),
+        avcC,
+    )
+}
+
+func (k trackKind) moov() []byte {
+    handler := "soun"
+    if !k.audio {
+        handler = "vide"
+    }
+    mdhd := box("mdhd", u32(0), u32(0), u32(0), u32(timescale), u32(0), u16(0x55c4), u16(0))
+    hdlr := box("hdlr", u32(0), u32(0), []byte(handler), zeros(12), []byte("fake\x00"))
+    stbl := box("stbl",
+        box("stsd", u32(0), u32(1), k.sampleEntry()),
+        box("stts", u32(0), u32(0)),
+        box("stsc", u32(0), u32(0)),
+        box("stsz", u32(0), u32(0), u32(0)),
+        box("stco", u32(0), u32(0)),
+    )
+    trak := box("trak",
+        box("tkhd", u32(3), u32(0), u32(0), u32(1), zeros(4), u32(0), zeros(60)),
+        box("mdia", mdhd, hdlr, box("minf", stbl)),
+    )
+    //frames are non-sync samples unless the moof says otherwise
+    mvex := box("mvex", box("trex", u32(0), u32(1), u32(1), u32(k.frameDuration), u32(uint32(k.frameSize)), u32(0x10000)))
+    return box("moov", box("mvhd", u32(0), zeros(8), u32(timescale), u32(0), zeros(80)), trak, mvex)
+}
+
+// builds a self-contained fragmented MP4 segment like the ones youtube
+// serves, starting with a keyframe and embedding its sequence number
+func (k trackKind) segment(sq int, segmentDuration uint32) []byte {
+    frames := k.frames(segmentDuration)
+    mdat := make([]byte, 0, frames * k.frameSize)
+    for i := 0; i < frames; i++ {
+        for j := 0; j < k.frameSize; j++ {
+            mdat = append(mdat, byte(sq + i + j))
+        }
+    }
+
+    meta := box("free", []byte(fmt.Sprintf("Sequence-Number: %d\r\nTarget-Duration-Us: %d\r\n", sq, uint64(segmentDuration) * 1000)))
+    moof := func(dataOffset uint32) []byte {
+        //first sample flags of 0 make the first frame a keyframe
+        trun := box("trun", u32(0x000005), u32(uint32(frames)), u32(dataOffset), u32(0))
+        tfhd := box("tfhd", u32(0x020000), u32(1))
+        tfdt := box("tfdt", u32(0x01000000), u64(uint64(sq) * uint64(segmentDuration)))
+        return box("moof", box("mfhd", u32(0), u32(uint32(sq))), box("traf", tfhd, tfdt, trun))
+    }
+    //the data offset is relative to the moof, which has a fixed size
+    first := moof(0)
+    return bytes.Join([][]byte {
+        box("ftyp", []byte("dash"), u32(0), []byte("iso6mp41")),
+        meta,
+        k.moov(),
+        moof(uint32(len(first) + 8)),
+        box("mdat", mdat),
+    }, nil)
+}
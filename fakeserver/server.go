@@ -0,0 +1,284 @@
+// Stand-in for youtube's segment servers, serving a synthetic stream so
+// downloading and muxing can be exercised without real download URLs.
+package fakeserver
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+const (
+    DefaultSegments        = 20
+    DefaultSegmentDuration = time.Second
+
+    AudioItag = 140
+    VideoItag = 137
+    VideoId   = "fakestream0"
+)
+
+// Which kind of download URL to hand out. Youtube uses both.
+type URLShape int
+const (
+    // parameters in the query string, /videoplayback?id=...&sq=N
+    URLQuery URLShape = iota
+    // parameters in the path, /videoplayback/id/.../sq/N
+    URLPath
+)
+
+// Problems to inject into segment responses. Faults only apply to the
+// segments selected by Every, except MissingLast.
+type Faults struct {
+    // affect every Nth segment, starting with the first one. 0 or 1 for all
+    // of them
+    Every       int
+    // how many requests for an affected segment are answered with 403
+    Forbidden   int
+    // how many requests after those get a body cut off halfway through
+    Truncated   int
+    // added before answering each segment request
+    Delay       time.Duration
+    // how many segments at the end of the stream always answer with 404,
+    // like ones youtube never made available
+    MissingLast int
+}
+
+type Options struct {
+    // DefaultSegments if 0
+    Segments        int
+    // DefaultSegmentDuration if 0, rounded down to multiples of 100ms
+    SegmentDuration time.Duration
+    Faults          Faults
+}
+
+// Request counts by outcome
+type Stats struct {
+    Served    int
+    Forbidden int
+    Truncated int
+    Missing   int
+    // requests that resumed a segment with a Range header
+    Ranged    int
+}
+
+type segmentKey struct {
+    itag int
+    sq   int
+}
+
+type Server struct {
+    opts     Options
+    // in milliseconds
+    duration uint32
+    srv      *httptest.Server
+    mu       sync.Mutex
+    attempts map[segmentKey]int
+    stats    Stats
+}
+
+// Starts serving a stream, Close must be called once done with it.
+func New(opts Options) *Server {
+    if opts.Segments <= 0 {
+        opts.Segments = DefaultSegments
+    }
+    if opts.SegmentDuration <= 0 {
+        opts.SegmentDuration = DefaultSegmentDuration
+    }
+    duration := uint32(opts.SegmentDuration / (100 * time.Millisecond)) * 100
+    if duration == 0 {
+        duration = 100
+    }
+    s := &Server {
+        opts:     opts,
+        duration: duration,
+        attempts: make(map[segmentKey]int),
+    }
+    s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+    return s
+}
+
+func (s *Server) Close() {
+    s.srv.Close()
+}
+
+func (s *Server) Stats() Stats {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.stats
+}
+
+// Download URL for a format, without a sequence number
+func (s *Server) URL(itag int, shape URLShape) string {
+    expire := time.Now().Add(6 * time.Hour).Unix()
+    if shape == URLPath {
+        return fmt.Sprintf("%s/videoplayback/id/%s.1/itag/%d/expire/%d/source/yt_live_broadcast", s.srv.URL, VideoId, itag, expire)
+    }
+    return fmt.Sprintf("%s/videoplayback?expire=%d&id=%s.1&itag=%d&source=yt_live_broadcast&noclen=1", s.srv.URL, expire, VideoId, itag)
+}
+
+// Input for downloading the stream, with one audio and one video format
+func (s *Server) FregData(shape URLShape) *util.FregJson {
+    return &util.FregJson {
+        Audio:    map[int]string { AudioItag: s.URL(AudioItag, shape) },
+        Video:    map[int]string { VideoItag: s.URL(VideoItag, shape) },
+        Metadata: util.FregMetadata {
+            Title:          "Fake stream",
+            Id:             VideoId,
+            ChannelName:    "Fake channel",
+            ChannelURL:     "https://www.youtube.com/channel/UCfakechannel",
+            StartTimestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+        },
+        Version:  "fake",
+    }
+}
+
+// Bytes of media data in every segment that can be downloaded, for checking
+// the size of muxed output
+func (s *Server) MediaBytes(itag int) int64 {
+    available := s.opts.Segments - s.opts.Faults.MissingLast
+    if available < 0 {
+        available = 0
+    }
+    return int64(available) * int64(kindOf(itag).mediaBytes(s.duration))
+}
+
+func kindOf(itag int) trackKind {
+    if itag == AudioItag {
+        return audioKind
+    }
+    return videoKind
+}
+
+// reads the itag and sequence number from either URL shape
+func parseRequest(r *http.Request) (int, int, error) {
+    query := r.URL.Query()
+    itag, sq := query.Get("itag"), query.Get("sq")
+    if strings.HasPrefix(r.URL.Path, "/videoplayback/") {
+        fields := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[1:]
+        for i := 0; i + 1 < len(fields); i += 2 {
+            switch fields[i] {
+            case "itag":
+                itag = fields[i + 1]
+            case "sq":
+                sq = fields[i + 1]
+            }
+        }
+    }
+    itagValue, err := strconv.Atoi(itag)
+    if err != nil {
+        return 0, 0, fmt.Errorf("Invalid itag '%s'", itag)
+    }
+    sqValue, err := strconv.Atoi(sq)
+    if err != nil {
+        return 0, 0, fmt.Errorf("Invalid sequence number '%s'", sq)
+    }
+    return itagValue, sqValue, nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+    itag, sq, err := parseRequest(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if itag != AudioItag && itag != VideoItag {
+        http.Error(w, "Unknown itag", http.StatusNotFound)
+        return
+    }
+
+    faults := s.opts.Faults
+    affected := faults.Every <= 1 || sq % faults.Every == 0
+    s.mu.Lock()
+    key := segmentKey { itag: itag, sq: sq }
+    attempt := s.attempts[key]
+    s.attempts[key]++
+    s.mu.Unlock()
+
+    if faults.Delay > 0 {
+        select {
+        case <-time.After(faults.Delay):
+        case <-r.Context().Done():
+            return
+        }
+    }
+
+    //youtube sends these on error responses too
+    w.Header().Set("x-head-seqnum", strconv.Itoa(s.opts.Segments))
+    w.Header().Set("x-head-time-ms", strconv.FormatUint(uint64(s.opts.Segments) * uint64(s.duration), 10))
+
+    switch {
+    case sq < 0 || sq >= s.opts.Segments - faults.MissingLast:
+        s.count(func(st *Stats) { st.Missing++ })
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    case affected && attempt < faults.Forbidden:
+        s.count(func(st *Stats) { st.Forbidden++ })
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    data := kindOf(itag).segment(sq, s.duration)
+    w.Header().Set("x-sequence-num", strconv.Itoa(sq))
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("Content-Type", "video/mp4")
+    if itag == AudioItag {
+        w.Header().Set("Content-Type", "audio/mp4")
+    }
+
+    if affected && attempt < faults.Forbidden + faults.Truncated {
+        s.count(func(st *Stats) { st.Truncated++ })
+        s.truncate(w, data)
+        return
+    }
+
+    status := http.StatusOK
+    if start, ok := parseRange(r.Header.Get("Range")); ok && start < len(data) {
+        w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data) - 1, len(data)))
+        data = data[start:]
+        status = http.StatusPartialContent
+        s.count(func(st *Stats) { st.Ranged++ })
+    }
+    s.count(func(st *Stats) { st.Served++ })
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    w.WriteHeader(status)
+    w.Write(data)
+}
+
+// sends half of the segment, then drops the connection
+func (s *Server) truncate(w http.ResponseWriter, data []byte) {
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    w.WriteHeader(http.StatusOK)
+    w.Write(data[:len(data) / 2])
+    if f, ok := w.(http.Flusher); ok {
+        f.Flush()
+    }
+    if h, ok := w.(http.Hijacker); ok {
+        if conn, _, err := h.Hijack(); err == nil {
+            conn.Close()
+        }
+    }
+}
+
+func (s *Server) count(f func(*Stats)) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    f(&s.stats)
+}
+
+// only "bytes=START-" ranges are supported, which is what resuming uses
+func parseRange(header string) (int, bool) {
+    if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+        return 0, false
+    }
+    start, err := strconv.Atoi(header[len("bytes="):len(header) - 1])
+    if err != nil || start < 0 {
+        return 0, false
+    }
+    return start, true
+}
@@ -83,6 +83,7 @@ var progress struct {
     mu          sync.Mutex
     buf         []byte
     titleBuf    []byte
+    disabled    bool
     status      map[ProgressCategory]progressStatus
     windowName  string
     wroteStatus bool
@@ -106,6 +107,15 @@ func doWrite(isProgress bool, data []byte) (int, error) {
     progress.buf = progress.buf[:0]
     progress.titleBuf = progress.titleBuf[:0]
 
+    if progress.disabled {
+        if len(data) > 0 {
+            progress.buf = append(progress.buf, data...)
+            progress.buf = append(progress.buf, '\n')
+            os.Stderr.Write(progress.buf)
+        }
+        return len(data), nil
+    }
+
     if progress.wroteStatus {
         moveCursorUp(&progress.buf, len(progressOrder))
     }
@@ -160,6 +170,14 @@ func SetWindowName(name string) {
     progress.windowName = name
 }
 
+// stops drawing the progress lines and window title, for when several
+// downloads would fight over them
+func DisableProgress() {
+    progress.mu.Lock()
+    defer progress.mu.Unlock()
+    progress.disabled = true
+}
+
 func Progress(category ProgressCategory, title string, message string) {
     func() {
         progress.mu.Lock()
@@ -1,13 +1,13 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "io/ioutil"
     "os"
-    "path/filepath"
 
     "github.com/mattn/go-colorable"
 
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
     "github.com/HoloArchivists/ytarchive-raw-go/download"
     "github.com/HoloArchivists/ytarchive-raw-go/log"
     "github.com/HoloArchivists/ytarchive-raw-go/merge"
@@ -25,6 +25,78 @@ func printResult(logger *log.Logger, res *download.DownloadResult) {
     }
 }
 
+func jobOptions(client *util.HttpClient, tempDir string) archive.Options {
+    return archive.Options {
+        AdaptiveThreads: adaptThreads,
+        Client:          client,
+        DisableResume:   disableResume,
+        EndTime:         endTime,
+        FailThreshold:   failThreshold,
+        Fsync:           fsync,
+        GapPolicy:       gapPolicy,
+        KeepFiles:       keepFiles,
+        Live:            live,
+        LiveTimeout:     liveTimeout,
+        MaxThreads:      maxThreads,
+        MergeWindow:     mergeWindow,
+        Merger:          merger,
+        MergerArguments: mergerArgs,
+        MinThreads:      minThreads,
+        OnlyAudio:       onlyAudio,
+        OnlyVideo:       onlyVideo,
+        Output:          output,
+        OverwriteTemp:   overwriteTemp,
+        PreferredAudio:  preferredAudio,
+        PreferredVideo:  preferredVideo,
+        QueueMode:       queueMode,
+        RateLimiter:     rateLimiter,
+        RequeueDelay:    requeueDelay,
+        RequeueFailed:   requeueFailed,
+        RequeueLast:     requeueLast,
+        RetryThreshold:  retryThreshold,
+        SegmentCount:    segmentCount,
+        SkipValidation:  skipValidation,
+        StartSegment:    startSegment,
+        StartTime:       startTime,
+        TaskRateLimit:   taskRateLimit,
+        TempBudget:      tempBudget,
+        TempDir:         tempDir,
+        Threads:         threads,
+    }
+}
+
+func printResumeHint(res *archive.Result) {
+    log.Warn("Stopped before finishing, downloaded segments were kept")
+    if res == nil {
+        log.Warn("Run the same command again to resume")
+    } else if tempDir == "" {
+        log.Warnf("Run the same command again with --temp-dir '%s' to resume", res.TempDir)
+    } else {
+        log.Warnf("Run the same command again to resume, segments are in '%s'", res.TempDir)
+    }
+}
+
+func printPoolHealth(pool *util.IPPool) {
+    if pool == nil {
+        return
+    }
+    logger := log.New("ip-pool")
+    for _, h := range pool.Health() {
+        if h.Requests == 0 {
+            continue
+        }
+        msg := fmt.Sprintf("%s: %d requests, %d failed (%.0f%% recent errors)", h.Source, h.Requests, h.Failures, h.ErrorRate * 100)
+        switch {
+        case h.Quarantined:
+            logger.Warnf("%s, quarantined %d time(s), still quarantined", msg, h.Quarantines)
+        case h.Quarantines > 0:
+            logger.Warnf("%s, quarantined %d time(s)", msg, h.Quarantines)
+        default:
+            logger.Info(msg)
+        }
+    }
+}
+
 func main() {
     colorable.EnableColorsStdout(nil)
     disableQuickEditMode()
@@ -36,31 +108,14 @@ func main() {
         log.Warnf("New version available: %s", latestVersion)
     }
 
-    deleteTempDir := false
-    if tempDir == "" {
-        var err error
-        tempDir, err = ioutil.TempDir("", fmt.Sprintf("ytarchive-%s-", fregData.Metadata.Id))
-        if err != nil {
-            log.Fatalf("Unable to create temp dir: %v", err)
-        }
-        log.Infof("Storing temporary files in %s", tempDir)
-        deleteTempDir = !keepFiles
-    } else {
-        if err := os.MkdirAll(tempDir, 0755); err != nil {
-            log.Fatalf("Unable to create temp dir at '%s': %v", tempDir, err)
-        }
-    }
-
-    defer util.LockFile(filepath.Join(tempDir, fregData.Metadata.Id + ".lock"), func() {
-        log.Error("This video is already being downloaded by another instance.")
-        log.Error("Running two instances on the same video with the same temporary directory is not supported.")
-    })()
+    ctx := shutdownContext()
 
     muxerOpts := &merge.MuxerOptions {
+        Context:         ctx,
         DeleteSegments:  !keepFiles,
         DisableResume:   disableResume,
         FinalFileBase:   output,
-        FregData:        &fregData,
+        GapPolicy:       gapPolicy,
         // this looks wrong but is correct
         IgnoreAudio:     onlyVideo,
         IgnoreVideo:     onlyAudio,
@@ -90,115 +145,74 @@ func main() {
         if ipPool, err = util.ParseIPPool(ipPoolFile); err != nil {
             log.Fatalf("Failed to parse IP pool: %v", err)
         }
+        if ipPool.HasRanges() && !freebind {
+            log.Warn("IP pool has ranges but --freebind isn't set, addresses that aren't assigned to an interface won't work")
+        }
+        ipPool.SetDefaultProxies(proxies)
+    } else if len(proxies) > 0 {
+        ipPool = util.NewProxyPool(proxies)
     }
-
-    client := util.NewClient(&util.HttpClientConfig {
-        IPPool:  ipPool,
-        Network: network,
-        UseQuic: useQuic,
-    })
-
-    muxer, err := merge.CreateBestMuxer(muxerOpts)
-    if err != nil {
-        log.Fatalf("Unable to create muxer: %v", err)
+    if ipPool != nil {
+        ipPool.ErrorThreshold = ipErrorRate
+        ipPool.Cooldown = ipCooldown
     }
 
-    dir := filepath.Dir(muxer.OutputFilePath())
-    err = os.MkdirAll(dir, 0755)
-    if err != nil {
-        log.Fatalf("Unable to create parent directories for output file: %v", err)
+    var middleware []util.Middleware
+    if faults != nil {
+        log.Warn("Injecting faults into requests, downloads will be slower and may lose segments")
+        middleware = append(middleware, util.FaultInjector(faults))
     }
 
-    defer util.LockFile(muxer.OutputFilePath() + ".lock", func() {
-        log.Error("Another instance is already writing to this output file.")
-    })()
+    client := util.NewClient(&util.HttpClientConfig {
+        Freebind:   freebind,
+        IPPool:     ipPool,
+        Middleware: middleware,
+        Network:    network,
+        UseQuic:    useQuic,
+    })
 
     log.SetWindowName(windowName)
-    progress := download.NewProgress()
-
-    var audioTask, videoTask *download.DownloadTask
-    if !onlyVideo {
-        audioTask = &download.DownloadTask {
-            Client:         client,
-            FailThreshold:  failThreshold,
-            Fsync:          fsync,
-            Logger:         log.New("download.audio"),
-            Merger:         muxer.AudioMerger(),
-            Progress:       progress.Audio(),
-            QueueMode:      queueMode,
-            RequeueDelay:   requeueDelay,
-            RequeueFailed:  requeueFailed,
-            RequeueLast:    requeueLast,
-            RetryThreshold: retryThreshold,
-            SegmentCount:   segmentCount,
-            SegmentDir:     tempDir,
-            StartSegment:   startSegment,
-            Threads:        threads,
-            Url:            fregData.BestAudio(preferredAudio),
-        }
+
+    if metricsListen != "" {
+        startMetricsServer(metricsListen)
     }
-    if !onlyAudio {
-        videoTask = &download.DownloadTask {
-            Client:         client,
-            FailThreshold:  failThreshold,
-            Fsync:          fsync,
-            Logger:         log.New("download.video"),
-            Merger:         muxer.VideoMerger(),
-            Progress:       progress.Video(),
-            QueueMode:      queueMode,
-            RequeueDelay:   requeueDelay,
-            RequeueFailed:  requeueFailed,
-            RequeueLast:    requeueLast,
-            RetryThreshold: retryThreshold,
-            SegmentCount:   segmentCount,
-            SegmentDir:     tempDir,
-            StartSegment:   startSegment,
-            Threads:        threads,
-            Url:            fregData.BestVideo(preferredVideo),
+
+    if serveMode {
+        err := runServer(ctx, client)
+        printPoolHealth(ipPool)
+        if err != nil {
+            log.Fatalf("%v", err)
         }
+        return
     }
 
-    if onlyAudio {
-        videoTask = nil
-        merge.MergeNothing(muxer.VideoMerger())
-    } else if onlyVideo {
-        audioTask = nil
-        merge.MergeNothing(muxer.AudioMerger())
-    }
+    if len(inputs) > 1 {
+        ok := runBatch(ctx, client)
+        printPoolHealth(ipPool)
 
-    if audioTask != nil {
-        audioTask.Start()
-    }
-    if videoTask != nil {
-        videoTask.Start()
+        if printNewVersion {
+            log.Warnf("New version available: %s", latestVersion)
+        }
+        if !ok {
+            os.Exit(1)
+        }
+        return
     }
 
-    //start muxer early so segments can be deleted if keep-files is disabled
-    //for the tcp muxer
-    muxerResult := make(chan error)
-    go func() {
-        muxerResult <- muxer.Mux()
-    }()
+    job := newJob(inputs[0].fregData, jobOptions(client, tempDir))
+    watchCtx, stopWatching := context.WithCancel(ctx)
+    go watchInput(watchCtx, job, inputs[0].path)
 
-    var audioRes, videoRes *download.DownloadResult
+    res, err := runJob(ctx, inputs[0].fregData, job)
+    stopWatching()
 
-    if audioTask != nil {
-        audioRes = audioTask.Wait()
+    if res != nil && res.Audio != nil {
+        printResult(log.New("download.audio"), res.Audio)
     }
-    if videoTask != nil {
-        videoRes = videoTask.Wait()
+    if res != nil && res.Video != nil {
+        printResult(log.New("download.video"), res.Video)
     }
-
-    if audioTask != nil {
-        printResult(audioTask.Logger, audioRes)
-    }
-    if videoTask != nil {
-        printResult(videoTask.Logger, videoRes)
-    }
-
-    log.Info("Waiting for muxing to finish")
-    log.Info("This can take a while for long videos, do NOT restart or all muxing progress will be lost")
-    res := <-muxerResult
+    printPoolHealth(ipPool)
 
     //print again once it's done so it doesn't get buried in newer logs
     if printNewVersion {
@@ -208,17 +222,14 @@ func main() {
         log.Warnf("Temporary files are configured to not be deleted. This will fill up your temporary storage over time.");
     }
 
-    if res != nil {
-        log.Fatalf("Muxing failed: %v", res)
+    if err == context.Canceled {
+        printResumeHint(res)
+        os.Exit(1)
     }
-
-    if deleteTempDir {
-        if err = os.RemoveAll(tempDir); err != nil {
-            log.Warnf("Failed to delete temp dir: %v", err)
-        }
+    if err != nil {
+        log.Fatalf("%v", err)
     }
 
     log.Info("Success!")
     fmt.Fprintf(os.Stderr, "\n")
 }
-
@@ -19,14 +19,15 @@ type ConcatMuxer struct {
 }
 
 func CreateConcatMuxer(options *MuxerOptions) (Muxer, error) {
-    progress := newProgress()
+    progress := newProgress(options.OnProgress)
+    gaps := newGapTracker()
 
-    audioMerger, err := createConcatTask(options, progress, "audio")
+    audioMerger, err := createConcatTask(options, progress, gaps, "audio")
     if err != nil {
         return nil, err
     }
 
-    videoMerger, err := createConcatTask(options, progress, "video")
+    videoMerger, err := createConcatTask(options, progress, gaps, "video")
     if err != nil {
         return nil, err
     }
@@ -52,14 +53,38 @@ func (m *ConcatMuxer) Mux() error {
     m.audioMerger.wg.Wait()
     m.videoMerger.wg.Wait()
 
+    //the merged files are incomplete and would prevent resuming without
+    //--overwrite-temp, the segments are still there to merge them again
+    if err := m.opts.context().Err(); err != nil {
+        m.removeMerged()
+        return err
+    }
+
     m.opts.Logger.Info("Merging into final file, progress won't be updated until it's done")
 
-    if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output()); err != nil {
+    chapters := concatChapters(m.audioMerger, m.videoMerger)
+    if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output(), chapters); err != nil {
+        if err == m.opts.context().Err() {
+            m.removeMerged()
+        }
         return err
     }
     m.progress.done()
 
     m.opts.Logger.Debug("Download succeeded, removing merged segments")
+    m.removeMerged()
+
+    if m.opts.DeleteSegments {
+        deleteSegmentFiles(m.audioMerger.segments)
+        deleteSegmentFiles(m.videoMerger.segments)
+        deleteSegmentFiles(m.audioMerger.cut)
+        deleteSegmentFiles(m.videoMerger.cut)
+    }
+
+    return nil
+}
+
+func (m *ConcatMuxer) removeMerged() {
     m.audioMerger.do(func() {
         if err := os.Remove(m.audioMerger.output()); err != nil {
             m.opts.Logger.Warnf("Failed to remove merged audio: %v", err)
@@ -70,13 +95,6 @@ func (m *ConcatMuxer) Mux() error {
             m.opts.Logger.Warnf("Failed to remove merged video: %v", err)
         }
     })
-
-    if m.opts.DeleteSegments {
-        deleteSegmentFiles(m.audioMerger.segments)
-        deleteSegmentFiles(m.videoMerger.segments)
-    }
-
-    return nil
 }
 
 func (m *ConcatMuxer) OutputFilePath() string {
@@ -86,11 +104,19 @@ func (m *ConcatMuxer) OutputFilePath() string {
 var _ Merger = &concatTask {}
 type concatTask struct {
     taskCommon
+    chapters       []mkvChapter
     deleteSegments bool
     segments       []string
+
+    // for gap markers
+    firstTimestamp int64
+    lastEnd        int64
+    lastOk         bool
+    lost           int
+    started        bool
 }
 
-func createConcatTask(options *MuxerOptions, progress *mergeProgress, which string) (*concatTask, error) {
+func createConcatTask(options *MuxerOptions, progress *mergeProgress, gaps *gapTracker, which string) (*concatTask, error) {
     file := filepath.Join(options.TempDir, fmt.Sprintf("merged-%s.%s", options.FregData.Metadata.Id, which))
     if util.FileNotEmpty(file) {
         if !options.OverwriteTemp {
@@ -104,11 +130,12 @@ func createConcatTask(options *MuxerOptions, progress *mergeProgress, which stri
     task := &concatTask {
         taskCommon:     taskCommon {
             ffmpegInput: file,
+            gaps:        gaps,
             options:     options,
             progress:    progress,
             which:       which,
         },
-        deleteSegments: options.DisableResume,
+        deleteSegments: options.deleteMerged(),
     }
     task.wg.Add(1)
     return task, nil
@@ -135,6 +162,11 @@ func (t *concatTask) Merge(status *segments.SegmentStatus) {
     defer t.wg.Done()
 
     t.forEachSegment(status, func(result segments.SegmentResult) {
+        if !result.Ok {
+            t.lost++
+        } else if t.options.GapPolicy == GapMarker {
+            t.markGap(result.Filename)
+        }
         if result.Ok {
             target := t.ffmpegInput
             err := copyFile(result.Filename, target)
@@ -142,7 +174,7 @@ func (t *concatTask) Merge(status *segments.SegmentStatus) {
                 t.log().Errorf("Unable to merge file '%s' into '%s': %v", result.Filename, target, err)
             } else {
                 if t.deleteSegments {
-                    os.Remove(result.Filename)
+                    t.removeSegment(result.Filename)
                 } else {
                     t.segments = append(t.segments, result.Filename)
                 }
@@ -151,3 +183,49 @@ func (t *concatTask) Merge(status *segments.SegmentStatus) {
     })
 }
 
+// gap chapters of every track, relative to the first merged timestamp of
+// either track like the native muxer does
+func concatChapters(tasks ...*concatTask) []mkvChapter {
+    first := int64(-1)
+    for _, t := range tasks {
+        if t.started && (first < 0 || t.firstTimestamp < first) {
+            first = t.firstTimestamp
+        }
+    }
+    var chapters []mkvChapter
+    for _, t := range tasks {
+        for _, c := range t.chapters {
+            chapters = append(chapters, mkvChapter {
+                start: c.start - first,
+                end:   c.end - first,
+                title: c.title,
+            })
+        }
+    }
+    sortChapters(chapters)
+    return chapters
+}
+
+// adds a chapter if segments were lost before this one. times are kept as
+// they are in the segments until muxing, see concatChapters.
+func (t *concatTask) markGap(path string) {
+    start, end, err := segmentTimes(path)
+    if err != nil {
+        t.log().Warnf("Unable to read timestamps of '%s', gaps around it won't be marked: %v", path, err)
+        t.lastOk = false
+        return
+    }
+    if !t.started {
+        t.started = true
+        t.firstTimestamp = start
+    } else if t.lost > 0 && t.lastOk && start > t.lastEnd {
+        t.chapters = append(t.chapters, mkvChapter {
+            start: t.lastEnd,
+            end:   start,
+            title: gapTitle(t.which, t.lost),
+        })
+    }
+    t.lost = 0
+    t.lastOk = true
+    t.lastEnd = end
+}
@@ -0,0 +1,38 @@
+package merge
+
+import (
+    "testing"
+)
+
+func TestConcatChapters(t *testing.T) {
+    audio := &concatTask {
+        started:        true,
+        firstTimestamp: 1000,
+        chapters:       []mkvChapter {
+            { start: 5000, end: 6000, title: "audio" },
+        },
+    }
+    video := &concatTask {
+        started:        true,
+        firstTimestamp: 1500,
+        chapters:       []mkvChapter {
+            { start: 3000, end: 4000, title: "video" },
+        },
+    }
+    //never merged anything, so it doesn't move the start
+    ignored := &concatTask {}
+
+    chapters := concatChapters(audio, video, ignored)
+    expected := []mkvChapter {
+        { start: 2000, end: 3000, title: "video" },
+        { start: 4000, end: 5000, title: "audio" },
+    }
+    if len(chapters) != len(expected) {
+        t.Fatalf("Expected %d chapters, got %v", len(expected), chapters)
+    }
+    for i, c := range chapters {
+        if c != expected[i] {
+            t.Errorf("Chapter %d is %v, expected %v", i, c, expected[i])
+        }
+    }
+}
@@ -0,0 +1,490 @@
+package merge
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+)
+
+var _ segmentDemuxer = &mp4Demuxer {}
+type mp4Demuxer struct {
+    info            *mkvTrackInfo
+    timescale       uint64
+    defaultDuration uint32
+    defaultSize     uint32
+    defaultFlags    uint32
+    // decode time of the next sample, for fragments without a tfdt box
+    nextDecodeTime  uint64
+}
+
+func newMp4Demuxer() *mp4Demuxer {
+    return &mp4Demuxer {}
+}
+
+func (d *mp4Demuxer) trackInfo() *mkvTrackInfo {
+    return d.info
+}
+
+type mp4Box struct {
+    typ string
+    // offset of the box header in the parsed data
+    start int
+    body  []byte
+}
+
+func readMp4Boxes(data []byte) ([]mp4Box, error) {
+    var boxes []mp4Box
+    offset := 0
+    for offset < len(data) {
+        if len(data) - offset < 8 {
+            return nil, fmt.Errorf("Truncated box header at offset %d", offset)
+        }
+        size := uint64(binary.BigEndian.Uint32(data[offset:]))
+        typ := string(data[offset + 4:offset + 8])
+        header := 8
+        if size == 1 {
+            if len(data) - offset < 16 {
+                return nil, fmt.Errorf("Truncated box header at offset %d", offset)
+            }
+            size = binary.BigEndian.Uint64(data[offset + 8:])
+            header = 16
+        } else if size == 0 {
+            size = uint64(len(data) - offset)
+        }
+        if size < uint64(header) || size > uint64(len(data) - offset) {
+            return nil, fmt.Errorf("Invalid size %d for box '%s' at offset %d", size, typ, offset)
+        }
+        boxes = append(boxes, mp4Box {
+            typ:   typ,
+            start: offset,
+            body:  data[offset + header:offset + int(size)],
+        })
+        offset += int(size)
+    }
+    return boxes, nil
+}
+
+func findMp4Box(boxes []mp4Box, path ...string) (*mp4Box, error) {
+    for i := range boxes {
+        if boxes[i].typ != path[0] {
+            continue
+        }
+        if len(path) == 1 {
+            return &boxes[i], nil
+        }
+        children, err := readMp4Boxes(boxes[i].body)
+        if err != nil {
+            return nil, err
+        }
+        return findMp4Box(children, path[1:]...)
+    }
+    return nil, nil
+}
+
+type mp4Reader struct {
+    data []byte
+    pos  int
+    err  error
+}
+
+func (r *mp4Reader) skip(n int) {
+    if r.err == nil && r.pos + n > len(r.data) {
+        r.err = fmt.Errorf("Unexpected end of box")
+    }
+    r.pos += n
+}
+
+func (r *mp4Reader) u8() uint8 {
+    r.skip(1)
+    if r.err != nil {
+        return 0
+    }
+    return r.data[r.pos - 1]
+}
+
+func (r *mp4Reader) u16() uint16 {
+    r.skip(2)
+    if r.err != nil {
+        return 0
+    }
+    return binary.BigEndian.Uint16(r.data[r.pos - 2:])
+}
+
+func (r *mp4Reader) u32() uint32 {
+    r.skip(4)
+    if r.err != nil {
+        return 0
+    }
+    return binary.BigEndian.Uint32(r.data[r.pos - 4:])
+}
+
+func (r *mp4Reader) u64() uint64 {
+    r.skip(8)
+    if r.err != nil {
+        return 0
+    }
+    return binary.BigEndian.Uint64(r.data[r.pos - 8:])
+}
+
+// reads the size of an mpeg-4 descriptor
+func (r *mp4Reader) descriptorSize() int {
+    size := 0
+    for i := 0; i < 4; i++ {
+        b := r.u8()
+        size = (size << 7) | int(b & 0x7F)
+        if b & 0x80 == 0 {
+            break
+        }
+    }
+    return size
+}
+
+// extracts the AudioSpecificConfig from an esds box
+func parseEsds(body []byte) ([]byte, error) {
+    r := &mp4Reader { data: body }
+    r.skip(4) //version + flags
+    for r.err == nil && r.pos < len(r.data) {
+        tag := r.u8()
+        size := r.descriptorSize()
+        switch tag {
+        case 0x03: //ES_Descriptor
+            r.skip(2)
+            flags := r.u8()
+            if flags & 0x80 != 0 {
+                r.skip(2)
+            }
+            if flags & 0x40 != 0 {
+                r.skip(int(r.u8()))
+            }
+            if flags & 0x20 != 0 {
+                r.skip(2)
+            }
+        case 0x04: //DecoderConfigDescriptor
+            r.skip(13)
+        case 0x05: //DecoderSpecificInfo
+            r.skip(size)
+            if r.err != nil {
+                return nil, r.err
+            }
+            return append([]byte(nil), r.data[r.pos - size:r.pos]...), nil
+        default:
+            r.skip(size)
+        }
+    }
+    if r.err != nil {
+        return nil, r.err
+    }
+    return nil, fmt.Errorf("No decoder specific info in esds box")
+}
+
+// converts a dOps box into the OpusHead expected by matroska
+func parseDops(body []byte) ([]byte, uint16, error) {
+    if len(body) < 11 {
+        return nil, 0, fmt.Errorf("dOps box too short")
+    }
+    head := []byte("OpusHead")
+    head = append(head, 1, body[1])
+    head = binary.LittleEndian.AppendUint16(head, binary.BigEndian.Uint16(body[2:]))
+    head = binary.LittleEndian.AppendUint32(head, binary.BigEndian.Uint32(body[4:]))
+    head = binary.LittleEndian.AppendUint16(head, binary.BigEndian.Uint16(body[8:]))
+    head = append(head, body[10:]...)
+    return head, binary.BigEndian.Uint16(body[2:]), nil
+}
+
+func (d *mp4Demuxer) parseSampleEntry(entry mp4Box) (*mkvTrackInfo, error) {
+    info := &mkvTrackInfo {}
+    r := &mp4Reader { data: entry.body }
+    var childOffset int
+    switch entry.typ {
+    case "avc1", "avc3", "vp09":
+        r.skip(24)
+        info.width = uint64(r.u16())
+        info.height = uint64(r.u16())
+        childOffset = 78
+    case "mp4a", "Opus":
+        info.audio = true
+        r.skip(8)
+        version := r.u16()
+        r.skip(6)
+        info.channels = uint64(r.u16())
+        info.bitDepth = uint64(r.u16())
+        r.skip(4)
+        info.samplingRate = float64(r.u32() >> 16)
+        childOffset = 28
+        switch version {
+        case 1:
+            childOffset += 16
+        case 2:
+            childOffset += 36
+        }
+    default:
+        return nil, fmt.Errorf("Unsupported codec '%s'", entry.typ)
+    }
+    if r.err != nil {
+        return nil, r.err
+    }
+    if childOffset > len(entry.body) {
+        return nil, fmt.Errorf("Sample entry '%s' too short", entry.typ)
+    }
+    children, err := readMp4Boxes(entry.body[childOffset:])
+    if err != nil {
+        return nil, err
+    }
+
+    switch entry.typ {
+    case "avc1", "avc3":
+        info.codecID = "V_MPEG4/ISO/AVC"
+        avcC, err := findMp4Box(children, "avcC")
+        if err != nil {
+            return nil, err
+        }
+        if avcC == nil {
+            return nil, fmt.Errorf("Missing avcC box")
+        }
+        info.codecPrivate = append([]byte(nil), avcC.body...)
+    case "vp09":
+        info.codecID = "V_VP9"
+    case "mp4a":
+        info.codecID = "A_AAC"
+        esds, err := findMp4Box(children, "esds")
+        if err != nil {
+            return nil, err
+        }
+        if esds == nil {
+            return nil, fmt.Errorf("Missing esds box")
+        }
+        if info.codecPrivate, err = parseEsds(esds.body); err != nil {
+            return nil, err
+        }
+        //bit depth is meaningless for aac
+        info.bitDepth = 0
+    case "Opus":
+        info.codecID = "A_OPUS"
+        dOps, err := findMp4Box(children, "dOps")
+        if err != nil {
+            return nil, err
+        }
+        if dOps == nil {
+            return nil, fmt.Errorf("Missing dOps box")
+        }
+        var preSkip uint16
+        if info.codecPrivate, preSkip, err = parseDops(dOps.body); err != nil {
+            return nil, err
+        }
+        info.codecDelay = uint64(preSkip) * 1000000000 / 48000
+        info.seekPreRoll = 80000000
+        info.bitDepth = 0
+    }
+    return info, nil
+}
+
+func (d *mp4Demuxer) parseMoov(moov mp4Box) error {
+    children, err := readMp4Boxes(moov.body)
+    if err != nil {
+        return err
+    }
+
+    mdhd, err := findMp4Box(children, "trak", "mdia", "mdhd")
+    if err != nil {
+        return err
+    }
+    if mdhd == nil {
+        return fmt.Errorf("Missing mdhd box")
+    }
+    r := &mp4Reader { data: mdhd.body }
+    if version := r.u8(); version == 1 {
+        r.skip(3 + 16)
+    } else {
+        r.skip(3 + 8)
+    }
+    d.timescale = uint64(r.u32())
+    if r.err != nil {
+        return r.err
+    }
+    if d.timescale == 0 {
+        return fmt.Errorf("Invalid timescale 0")
+    }
+
+    stsd, err := findMp4Box(children, "trak", "mdia", "minf", "stbl", "stsd")
+    if err != nil {
+        return err
+    }
+    if stsd == nil || len(stsd.body) < 8 {
+        return fmt.Errorf("Missing stsd box")
+    }
+    entries, err := readMp4Boxes(stsd.body[8:])
+    if err != nil {
+        return err
+    }
+    if len(entries) == 0 {
+        return fmt.Errorf("No sample entries in stsd box")
+    }
+    if d.info, err = d.parseSampleEntry(entries[0]); err != nil {
+        return err
+    }
+
+    trex, err := findMp4Box(children, "mvex", "trex")
+    if err != nil {
+        return err
+    }
+    if trex != nil {
+        r := &mp4Reader { data: trex.body }
+        r.skip(12)
+        d.defaultDuration = r.u32()
+        d.defaultSize = r.u32()
+        d.defaultFlags = r.u32()
+        if r.err != nil {
+            return r.err
+        }
+    }
+    return nil
+}
+
+func (d *mp4Demuxer) toNanos(v uint64) int64 {
+    return int64((v / d.timescale) * 1000000000 + (v % d.timescale) * 1000000000 / d.timescale)
+}
+
+func (d *mp4Demuxer) signedNanos(v int64) int64 {
+    if v < 0 {
+        return -d.toNanos(uint64(-v))
+    }
+    return d.toNanos(uint64(v))
+}
+
+func (d *mp4Demuxer) parseMoof(data []byte, moof mp4Box) ([]mkvFrame, error) {
+    children, err := readMp4Boxes(moof.body)
+    if err != nil {
+        return nil, err
+    }
+    var frames []mkvFrame
+    for _, traf := range children {
+        if traf.typ != "traf" {
+            continue
+        }
+        trafChildren, err := readMp4Boxes(traf.body)
+        if err != nil {
+            return nil, err
+        }
+
+        baseOffset := uint64(moof.start)
+        defaultDuration := d.defaultDuration
+        defaultSize := d.defaultSize
+        defaultFlags := d.defaultFlags
+        for _, box := range trafChildren {
+            r := &mp4Reader { data: box.body }
+            switch box.typ {
+            case "tfhd":
+                flags := r.u32() & 0xFFFFFF
+                r.skip(4) //track id
+                if flags & 0x01 != 0 {
+                    baseOffset = r.u64()
+                }
+                if flags & 0x02 != 0 {
+                    r.skip(4)
+                }
+                if flags & 0x08 != 0 {
+                    defaultDuration = r.u32()
+                }
+                if flags & 0x10 != 0 {
+                    defaultSize = r.u32()
+                }
+                if flags & 0x20 != 0 {
+                    defaultFlags = r.u32()
+                }
+            case "tfdt":
+                if version := r.u8(); version == 1 {
+                    r.skip(3)
+                    d.nextDecodeTime = r.u64()
+                } else {
+                    r.skip(3)
+                    d.nextDecodeTime = uint64(r.u32())
+                }
+            case "trun":
+                versionFlags := r.u32()
+                version := versionFlags >> 24
+                flags := versionFlags & 0xFFFFFF
+                count := r.u32()
+                offset := baseOffset
+                if flags & 0x01 != 0 {
+                    //the data offset is signed, and base offsets past
+                    //the segment are caught by the bounds check below
+                    sum := int64(baseOffset) + int64(int32(r.u32()))
+                    if baseOffset > math.MaxInt64 || sum < 0 {
+                        return nil, fmt.Errorf("Sample data out of bounds")
+                    }
+                    offset = uint64(sum)
+                }
+                firstFlags, hasFirstFlags := uint32(0), flags & 0x04 != 0
+                if hasFirstFlags {
+                    firstFlags = r.u32()
+                }
+                for i := uint32(0); i < count && r.err == nil; i++ {
+                    duration, size, sampleFlags := defaultDuration, defaultSize, defaultFlags
+                    var cto int64
+                    if flags & 0x100 != 0 {
+                        duration = r.u32()
+                    }
+                    if flags & 0x200 != 0 {
+                        size = r.u32()
+                    }
+                    if flags & 0x400 != 0 {
+                        sampleFlags = r.u32()
+                    } else if i == 0 && hasFirstFlags {
+                        sampleFlags = firstFlags
+                    }
+                    if flags & 0x800 != 0 {
+                        if version == 0 {
+                            cto = int64(r.u32())
+                        } else {
+                            cto = int64(int32(r.u32()))
+                        }
+                    }
+                    if offset > uint64(len(data)) || uint64(size) > uint64(len(data)) - offset {
+                        return nil, fmt.Errorf("Sample data out of bounds")
+                    }
+                    frames = append(frames, mkvFrame {
+                        timestamp: d.toNanos(d.nextDecodeTime) + d.signedNanos(cto),
+                        //sample_is_non_sync_sample
+                        keyframe:  d.info.audio || sampleFlags & 0x10000 == 0,
+                        data:      data[offset:offset + uint64(size)],
+                    })
+                    offset += uint64(size)
+                    d.nextDecodeTime += uint64(duration)
+                }
+            }
+            if r.err != nil {
+                return nil, fmt.Errorf("Invalid '%s' box: %v", box.typ, r.err)
+            }
+        }
+    }
+    return frames, nil
+}
+
+func (d *mp4Demuxer) demux(data []byte) ([]mkvFrame, error) {
+    boxes, err := readMp4Boxes(data)
+    if err != nil {
+        return nil, err
+    }
+    var frames []mkvFrame
+    for _, box := range boxes {
+        switch box.typ {
+        case "moov":
+            if err = d.parseMoov(box); err != nil {
+                return nil, err
+            }
+        case "moof":
+            if d.info == nil {
+                return nil, fmt.Errorf("Fragment found before moov box")
+            }
+            f, err := d.parseMoof(data, box)
+            if err != nil {
+                return nil, err
+            }
+            frames = append(frames, f...)
+        }
+    }
+    if d.info == nil {
+        return nil, fmt.Errorf("No moov box found")
+    }
+    return frames, nil
+}
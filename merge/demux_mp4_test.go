@@ -0,0 +1,78 @@
+package merge
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+func testBox(typ string, parts ...[]byte) []byte {
+    body := bytes.Join(parts, nil)
+    out := make([]byte, 8, 8 + len(body))
+    binary.BigEndian.PutUint32(out, uint32(8 + len(body)))
+    copy(out[4:], typ)
+    return append(out, body...)
+}
+
+func testU32(v uint32) []byte {
+    return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func testU64(v uint64) []byte {
+    return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// parses a segment made of a moof with the given tfhd and trun bodies,
+// followed by an mdat with 64 bytes of data
+func parseTestMoof(t *testing.T, tfhd, trun []byte) ([]mkvFrame, error) {
+    t.Helper()
+    moof := testBox("moof", testBox("traf", testBox("tfhd", tfhd), testBox("trun", trun)))
+    data := append(moof, testBox("mdat", make([]byte, 64))...)
+    boxes, err := readMp4Boxes(data)
+    if err != nil {
+        t.Fatalf("Invalid test segment: %v", err)
+    }
+    d := &mp4Demuxer {
+        info:      &mkvTrackInfo {},
+        timescale: 1000,
+    }
+    return d.parseMoof(data, boxes[0])
+}
+
+func TestParseMoofDataOffset(t *testing.T) {
+    tfhd := bytes.Join([][]byte { testU32(0), testU32(1) }, nil)
+    //one sample of 16 bytes, placed with a data offset
+    trun := func(dataOffset int32) []byte {
+        return bytes.Join([][]byte { testU32(0x201), testU32(1), testU32(uint32(dataOffset)), testU32(16) }, nil)
+    }
+
+    frames, err := parseTestMoof(t, tfhd, trun(80))
+    if err != nil {
+        t.Fatalf("Valid segment failed to parse: %v", err)
+    }
+    if len(frames) != 1 || len(frames[0].data) != 16 {
+        t.Fatalf("Expected one frame of 16 bytes, got %v", frames)
+    }
+
+    if _, err = parseTestMoof(t, tfhd, trun(-1000)); err == nil {
+        t.Error("Negative data offset was accepted")
+    }
+    if _, err = parseTestMoof(t, tfhd, trun(1 << 30)); err == nil {
+        t.Error("Data offset past the segment was accepted")
+    }
+}
+
+func TestParseMoofHugeBaseOffset(t *testing.T) {
+    //explicit base offset that overflows when the sample size is added
+    tfhd := bytes.Join([][]byte { testU32(0x01), testU32(1), testU64(^uint64(0) - 7) }, nil)
+    trun := bytes.Join([][]byte { testU32(0x200), testU32(1), testU32(16) }, nil)
+    if _, err := parseTestMoof(t, tfhd, trun); err == nil {
+        t.Error("Base offset past the segment was accepted")
+    }
+
+    //same with a data offset on top of it
+    trun = bytes.Join([][]byte { testU32(0x201), testU32(1), testU32(8), testU32(16) }, nil)
+    if _, err := parseTestMoof(t, tfhd, trun); err == nil {
+        t.Error("Base offset past the segment was accepted")
+    }
+}
@@ -0,0 +1,264 @@
+package merge
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+)
+
+var _ segmentDemuxer = &webmDemuxer {}
+type webmDemuxer struct {
+    info          *mkvTrackInfo
+    track         uint64
+    timecodeScale int64
+}
+
+func newWebmDemuxer() *webmDemuxer {
+    return &webmDemuxer {
+        timecodeScale: 1000000,
+    }
+}
+
+func (d *webmDemuxer) trackInfo() *mkvTrackInfo {
+    return d.info
+}
+
+func readEbmlID(data []byte) (uint32, int, error) {
+    if len(data) == 0 {
+        return 0, 0, fmt.Errorf("Unexpected end of data reading element ID")
+    }
+    length := 1
+    for mask := byte(0x80); length <= 4 && data[0] & mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > 4 {
+        return 0, 0, fmt.Errorf("Invalid element ID 0x%02x", data[0])
+    }
+    if len(data) < length {
+        return 0, 0, fmt.Errorf("Unexpected end of data reading element ID")
+    }
+    var id uint32
+    for i := 0; i < length; i++ {
+        id = (id << 8) | uint32(data[i])
+    }
+    return id, length, nil
+}
+
+// returns the value, its length and whether it's the reserved "unknown" value
+func readEbmlVint(data []byte) (uint64, int, bool, error) {
+    if len(data) == 0 {
+        return 0, 0, false, fmt.Errorf("Unexpected end of data reading vint")
+    }
+    length := 1
+    for mask := byte(0x80); length <= 8 && data[0] & mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > 8 {
+        return 0, 0, false, fmt.Errorf("Invalid vint 0x%02x", data[0])
+    }
+    if len(data) < length {
+        return 0, 0, false, fmt.Errorf("Unexpected end of data reading vint")
+    }
+    v := uint64(data[0] & (0xFF >> length))
+    for i := 1; i < length; i++ {
+        v = (v << 8) | uint64(data[i])
+    }
+    unknown := v == (1 << (7 * length)) - 1
+    return v, length, unknown, nil
+}
+
+func ebmlUint(data []byte) uint64 {
+    var v uint64
+    for _, b := range data {
+        v = (v << 8) | uint64(b)
+    }
+    return v
+}
+
+func ebmlFloat(data []byte) float64 {
+    switch len(data) {
+    case 4:
+        return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+    case 8:
+        return math.Float64frombits(binary.BigEndian.Uint64(data))
+    default:
+        return 0
+    }
+}
+
+// calls f for each element in data. f returns whether it wants to descend
+// into the element instead of skipping over it, which is required for
+// elements with an unknown size. if strict, elements that are descended into
+// also can't be truncated.
+func walkEbml(data []byte, strict bool, f func(id uint32, body []byte) (bool, error)) error {
+    for len(data) > 0 {
+        id, idLen, err := readEbmlID(data)
+        if err != nil {
+            return err
+        }
+        size, sizeLen, unknown, err := readEbmlVint(data[idLen:])
+        if err != nil {
+            return err
+        }
+        data = data[idLen + sizeLen:]
+
+        var body []byte
+        if unknown || size > uint64(len(data)) {
+            //truncated or unknown size, only usable by descending into it
+            body = data
+        } else {
+            body = data[:size]
+        }
+        descend, err := f(id, body)
+        if err != nil {
+            return err
+        }
+        if descend {
+            if strict && !unknown && size > uint64(len(data)) {
+                return fmt.Errorf("Element 0x%x is truncated", id)
+            }
+            continue
+        }
+        if unknown {
+            return fmt.Errorf("Element 0x%x has unknown size", id)
+        }
+        if size > uint64(len(data)) {
+            return fmt.Errorf("Element 0x%x is truncated", id)
+        }
+        data = data[size:]
+    }
+    return nil
+}
+
+func (d *webmDemuxer) parseTrack(body []byte) error {
+    info := &mkvTrackInfo {}
+    var number, typ uint64
+    err := walkEbml(body, false, func(id uint32, body []byte) (bool, error) {
+        switch id {
+        case mkvTrackNumber:
+            number = ebmlUint(body)
+        case mkvTrackType:
+            typ = ebmlUint(body)
+        case mkvCodecID:
+            info.codecID = string(body)
+        case mkvCodecPrivate:
+            info.codecPrivate = append([]byte(nil), body...)
+        case mkvCodecDelay:
+            info.codecDelay = ebmlUint(body)
+        case mkvSeekPreRoll:
+            info.seekPreRoll = ebmlUint(body)
+        case mkvDefaultDuration:
+            info.defaultDuration = ebmlUint(body)
+        case mkvVideo, mkvAudio:
+            return true, nil
+        case mkvPixelWidth:
+            info.width = ebmlUint(body)
+        case mkvPixelHeight:
+            info.height = ebmlUint(body)
+        case mkvSamplingFrequency:
+            info.samplingRate = ebmlFloat(body)
+        case mkvChannels:
+            info.channels = ebmlUint(body)
+        case mkvBitDepth:
+            info.bitDepth = ebmlUint(body)
+        }
+        return false, nil
+    })
+    if err != nil {
+        return err
+    }
+    if typ != mkvTrackTypeAudio && typ != mkvTrackTypeVideo {
+        return nil
+    }
+    info.audio = typ == mkvTrackTypeAudio
+    if info.audio && info.channels == 0 {
+        info.channels = 1
+    }
+    //segments only have a single track, use the first one found
+    if d.track == 0 || d.track == number {
+        d.track = number
+        d.info = info
+    }
+    return nil
+}
+
+func (d *webmDemuxer) parseBlock(body []byte, clusterTime int64, simple bool, keyframe bool) (*mkvFrame, error) {
+    track, length, _, err := readEbmlVint(body)
+    if err != nil {
+        return nil, err
+    }
+    if len(body) < length + 3 {
+        return nil, fmt.Errorf("Block too short")
+    }
+    if track != d.track {
+        return nil, nil
+    }
+    rel := int16(binary.BigEndian.Uint16(body[length:]))
+    flags := body[length + 2]
+    if simple {
+        keyframe = flags & 0x80 != 0
+    }
+    return &mkvFrame {
+        timestamp: (clusterTime + int64(rel)) * d.timecodeScale,
+        keyframe:  keyframe,
+        flags:     flags & 0x0F,
+        data:      body[length + 3:],
+    }, nil
+}
+
+func (d *webmDemuxer) demux(data []byte) ([]mkvFrame, error) {
+    var frames []mkvFrame
+    var clusterTime int64
+    err := walkEbml(data, false, func(id uint32, body []byte) (bool, error) {
+        switch id {
+        case mkvSegment, mkvCluster, mkvTracks, mkvInfo:
+            return true, nil
+        case mkvTimestampScale:
+            d.timecodeScale = int64(ebmlUint(body))
+        case mkvTrackEntry:
+            return false, d.parseTrack(body)
+        case mkvTimestamp:
+            clusterTime = int64(ebmlUint(body))
+        case mkvSimpleBlock:
+            frame, err := d.parseBlock(body, clusterTime, true, false)
+            if err != nil {
+                return false, err
+            }
+            if frame != nil {
+                frames = append(frames, *frame)
+            }
+        case mkvBlockGroup:
+            var block []byte
+            keyframe := true
+            err := walkEbml(body, false, func(id uint32, body []byte) (bool, error) {
+                switch id {
+                case mkvBlock:
+                    block = body
+                case mkvReferenceBlock:
+                    keyframe = false
+                }
+                return false, nil
+            })
+            if err != nil {
+                return false, err
+            }
+            if block != nil {
+                frame, err := d.parseBlock(block, clusterTime, false, keyframe)
+                if err != nil {
+                    return false, err
+                }
+                if frame != nil {
+                    frames = append(frames, *frame)
+                }
+            }
+        }
+        return false, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if d.info == nil {
+        return nil, fmt.Errorf("No tracks found")
+    }
+    return frames, nil
+}
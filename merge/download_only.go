@@ -6,7 +6,6 @@ import (
     "io/ioutil"
 
     "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
-    "github.com/HoloArchivists/ytarchive-raw-go/log"
     "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
@@ -62,9 +61,14 @@ func MergeDownloadInfoJson(options *MuxerOptions, path string) error {
     }
     options.FinalFileBase = output
 
-    defer util.LockFile(output + ".lock", func() {
-        log.Error("Another instance is already writing to this output file.")
-    })()
+    unlock, err := util.TryLockFile(output + ".lock")
+    if err == util.ErrLocked {
+        return fmt.Errorf("Another instance is already writing to this output file")
+    }
+    if err != nil {
+        return err
+    }
+    defer unlock()
 
     options.Logger.Infof("Saving output to %s", output)
 
@@ -81,12 +85,13 @@ func MergeDownloadInfoJson(options *MuxerOptions, path string) error {
 }
 
 func CreateDownloadOnlyMuxer(options *MuxerOptions) (Muxer, error) {
-    progress := newProgress()
+    progress := newProgress(options.OnProgress)
+    gaps := newGapTracker()
     return &DownloadOnlyMuxer {
         opts:        options,
         progress:    progress,
-        audioMerger: createDownloadOnlyTask(options, progress, "audio"),
-        videoMerger: createDownloadOnlyTask(options, progress, "video"),
+        audioMerger: createDownloadOnlyTask(options, progress, gaps, "audio"),
+        videoMerger: createDownloadOnlyTask(options, progress, gaps, "video"),
     }, nil
 }
 
@@ -101,6 +106,9 @@ func (m *DownloadOnlyMuxer) VideoMerger() Merger {
 func (m *DownloadOnlyMuxer) Mux() error {
     m.audioMerger.wg.Wait()
     m.videoMerger.wg.Wait()
+    if err := m.opts.context().Err(); err != nil {
+        return err
+    }
     m.progress.done()
 
     d := &downloadJson {
@@ -126,10 +134,11 @@ type downloadOnlyTask struct {
     segments   []segments.SegmentResult
 }
 
-func createDownloadOnlyTask(options *MuxerOptions, progress *mergeProgress, which string) *downloadOnlyTask {
+func createDownloadOnlyTask(options *MuxerOptions, progress *mergeProgress, gaps *gapTracker, which string) *downloadOnlyTask {
     task := &downloadOnlyTask {
         taskCommon: taskCommon {
             ffmpegInput: "nil",
+            gaps:        gaps,
             options:     options,
             progress:    progress,
             which:       which,
@@ -3,23 +3,31 @@ package merge
 import (
     "bufio"
     "bytes"
+    "context"
     "fmt"
+    "io/ioutil"
     "os"
     "os/exec"
     "path/filepath"
     "strings"
+    "time"
 
     "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
 )
 
 func ffmpeg(logger *log.Logger, args ...string) *exec.Cmd {
+    return ffmpegContext(context.Background(), logger, args...)
+}
+
+func ffmpegContext(ctx context.Context, logger *log.Logger, args ...string) *exec.Cmd {
     argv := make([]string, 0)
     argv = append(argv, "-v", "warning")
     argv = append(argv, args...)
     if logger != nil {
         logger.Debugf("FFmpeg command: %v", argv)
     }
-    return exec.Command("ffmpeg", argv...)
+    return exec.CommandContext(ctx, "ffmpeg", argv...)
 }
 
 func testFfmpeg() error {
@@ -35,12 +43,61 @@ func hasProtocol(name string) bool {
     cmd.Stdin = nil
     output, err := cmd.Output()
     if err != nil {
-        log.Fatalf("Unable to find ffmpeg: %v", err)
+        log.Warnf("Unable to check for ffmpeg protocol %s: %v", name, err)
+        return false
     }
     return !bytes.Contains(output, []byte("Unknown protocol "))
 }
 
-func muxFfmpeg(options *MuxerOptions, audio, video string) error {
+// metadata written to the output file
+func outputMetadata(fregData *util.FregJson) []metadataTag {
+    return []metadataTag {
+        { name: "date",       value: fregData.Metadata.StartTimestamp.Format("20060201") },
+        { name: "title",      value: fregData.Metadata.Title },
+        { name: "comment",    value: fregData.Metadata.Description },
+        { name: "author",     value: fregData.Metadata.ChannelName },
+        { name: "artist",     value: fregData.Metadata.ChannelName },
+        { name: "episode_id", value: fregData.Metadata.Id },
+    }
+}
+
+// writes chapters in ffmpeg's metadata format
+func writeChapters(path string, chapters []mkvChapter) error {
+    escape := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+    var b strings.Builder
+    b.WriteString(";FFMETADATA1\n")
+    for _, c := range chapters {
+        fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000000000\nSTART=%d\nEND=%d\ntitle=%s\n", c.start, c.end, escape.Replace(c.title))
+    }
+    return ioutil.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func ffmpegTime(d time.Duration) string {
+    return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// options for each media input when clipping. as input options, ffmpeg
+// seeks to the keyframe before the start, so the clip can be decoded from
+// its first frame like the native muxer's. inputs that can't seek, such as
+// the tcp merger's, are read up to the start instead and begin at the next
+// keyframe, since leading non-keyframes aren't copied
+func clipInputArgs(options *MuxerOptions) []string {
+    if options.ClipStart <= 0 {
+        return nil
+    }
+    return []string { "-ss", ffmpegTime(options.ClipStart) }
+}
+
+// output options when clipping. the output starts at the clip start, so the
+// end becomes a duration
+func clipOutputArgs(options *MuxerOptions) []string {
+    if options.ClipEnd <= 0 {
+        return nil
+    }
+    return []string { "-t", ffmpegTime(options.ClipEnd - options.ClipStart) }
+}
+
+func muxFfmpeg(options *MuxerOptions, audio, video string, chapters []mkvChapter) error {
     if audio == "" && video == "" {
         return fmt.Errorf("No audio or video inputs provided")
     }
@@ -52,31 +109,40 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
         "-y",
     )
     if audio != "" {
+        args = append(args, clipInputArgs(options)...)
         args = append(args, "-i", audio)
     }
     if video != "" {
+        args = append(args, clipInputArgs(options)...)
         args = append(args, "-i", video)
     }
+    if len(chapters) > 0 {
+        chapterFile := filepath.Join(options.TempDir, fmt.Sprintf("chapters-%s.txt", options.FregData.Metadata.Id))
+        if err := writeChapters(chapterFile, chapters); err != nil {
+            return fmt.Errorf("Unable to write chapter file: %v", err)
+        }
+        defer os.Remove(chapterFile)
+        inputs := 0
+        if audio != "" {
+            inputs++
+        }
+        if video != "" {
+            inputs++
+        }
+        args = append(args, "-i", chapterFile, "-map_chapters", fmt.Sprint(inputs))
+    }
+    args = append(args, clipOutputArgs(options)...)
     args = append(args, "-c", "copy")
 
     thumbnail := options.FinalFileBase + ".jpg"
     if err := options.FregData.WriteThumbnail(thumbnail); err != nil {
         return fmt.Errorf("Unable to write thumbnail file: %v", err)
     }
+    for _, tag := range outputMetadata(options.FregData) {
+        args = append(args, "-metadata", tag.name + "=" + tag.value)
+    }
     args = append(
         args,
-        "-metadata",
-        "date=" + options.FregData.Metadata.StartTimestamp.Format("20060201"),
-        "-metadata",
-        "title=" + options.FregData.Metadata.Title,
-        "-metadata",
-        "comment=" + options.FregData.Metadata.Description,
-        "-metadata",
-        "author=" + options.FregData.Metadata.ChannelName,
-        "-metadata",
-        "artist=" + options.FregData.Metadata.ChannelName,
-        "-metadata",
-        "episode_id=" + options.FregData.Metadata.Id,
         "-attach",
         thumbnail,
         "-metadata:s:t",
@@ -86,7 +152,12 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
     )
     args = append(args, options.FinalFileBase + ".mkv")
 
-    cmd := ffmpeg(options.Logger, args...)
+    ctx := options.context()
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    //killed on cancellation, so it doesn't keep writing a partial file
+    cmd := ffmpegContext(ctx, options.Logger, args...)
     logFile := filepath.Join(options.TempDir, fmt.Sprintf("ffmpeg-%s.out", options.FregData.Metadata.Id))
     cmd.Env = append(
         os.Environ(),
@@ -98,7 +169,14 @@ func muxFfmpeg(options *MuxerOptions, audio, video string) error {
     cmd.Stdout = nil
     cmd.Stderr = &stderr
 
-    if err := cmd.Run(); err != nil {
+    err := cmd.Run()
+    //killed because of the cancellation, or stopped early because the
+    //inputs ended. either way the output is incomplete
+    if ctx.Err() != nil {
+        os.Remove(options.FinalFileBase + ".mkv")
+        return ctx.Err()
+    }
+    if err != nil {
         printOutput(options.Logger, &stderr, false)
         options.Logger.Errorf("Check the FFmpeg log file at '%s'", logFile)
         return err
@@ -0,0 +1,30 @@
+package merge
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestClipArgs(t *testing.T) {
+    tests := []struct {
+        start  time.Duration
+        end    time.Duration
+        input  []string
+        output []string
+    } {
+        { start: 0, end: 0 },
+        { start: 1500 * time.Millisecond, end: 0, input: []string { "-ss", "1.500" } },
+        { start: 0, end: 10 * time.Second, output: []string { "-t", "10.000" } },
+        { start: 2 * time.Second, end: 7250 * time.Millisecond, input: []string { "-ss", "2.000" }, output: []string { "-t", "5.250" } },
+    }
+    for _, test := range tests {
+        opts := &MuxerOptions { ClipStart: test.start, ClipEnd: test.end }
+        if got := clipInputArgs(opts); !reflect.DeepEqual(got, test.input) {
+            t.Errorf("Input args for %v-%v are %v, expected %v", test.start, test.end, got, test.input)
+        }
+        if got := clipOutputArgs(opts); !reflect.DeepEqual(got, test.output) {
+            t.Errorf("Output args for %v-%v are %v, expected %v", test.start, test.end, got, test.output)
+        }
+    }
+}
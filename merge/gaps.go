@@ -0,0 +1,198 @@
+package merge
+
+import (
+    "fmt"
+    "io/ioutil"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+)
+
+// What to do with the output around segments that couldn't be downloaded.
+type GapPolicy int
+const (
+    // leave the lost segment out of its track, the other track is untouched
+    GapIgnore GapPolicy = iota
+    // also leave out the matching segment of the other track
+    GapCut
+    // fill the gap with silence or a still frame, native merger only
+    GapFill
+    // add a chapter at the gap position, native and concat mergers only
+    GapMarker
+)
+
+var gapPolicyNames = map[string]GapPolicy {
+    "ignore": GapIgnore,
+    "cut":    GapCut,
+    "fill":   GapFill,
+    "marker": GapMarker,
+}
+
+func ParseGapPolicy(s string) (GapPolicy, error) {
+    p, ok := gapPolicyNames[strings.ToLower(s)]
+    if !ok {
+        return GapIgnore, fmt.Errorf("Invalid gap policy '%s', must be one of ignore, cut, fill, marker", s)
+    }
+    return p, nil
+}
+
+func (p GapPolicy) String() string {
+    for name, v := range gapPolicyNames {
+        if v == p {
+            return name
+        }
+    }
+    return fmt.Sprintf("GapPolicy(%d)", int(p))
+}
+
+// chapter marking a gap, times in nanoseconds
+type mkvChapter struct {
+    start int64
+    end   int64
+    title string
+}
+
+func sortChapters(chapters []mkvChapter) {
+    sort.Slice(chapters, func(i, j int) bool {
+        return chapters[i].start < chapters[j].start
+    })
+}
+
+func gapTitle(which string, lost int) string {
+    if lost == 1 {
+        return fmt.Sprintf("Missing %s (1 segment)", which)
+    }
+    return fmt.Sprintf("Missing %s (%d segments)", which, lost)
+}
+
+// Shared by the audio and video mergers of a muxer, so one track can find
+// out which segments the other one lost.
+type gapTracker struct {
+    mu       sync.Mutex
+    // closed and replaced whenever a track is added or ignored
+    changed  chan struct{}
+    statuses map[string]*segments.SegmentStatus
+    ignored  map[string]bool
+}
+
+func newGapTracker() *gapTracker {
+    return &gapTracker {
+        changed:  make(chan struct{}),
+        statuses: make(map[string]*segments.SegmentStatus),
+        ignored:  make(map[string]bool),
+    }
+}
+
+//must be called with the lock held
+func (g *gapTracker) notify() {
+    close(g.changed)
+    g.changed = make(chan struct{})
+}
+
+func otherTrack(which string) string {
+    if which == "audio" {
+        return "video"
+    }
+    return "audio"
+}
+
+func (g *gapTracker) track(which string, s *segments.SegmentStatus) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.statuses[which] = s
+    g.notify()
+}
+
+func (g *gapTracker) ignore(which string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.ignored[which] = true
+    g.notify()
+}
+
+// whether the other track lost a segment, waiting until its download
+// finished or failed
+func (t *taskCommon) otherLost(number int) bool {
+    other := otherTrack(t.which)
+    for {
+        t.gaps.mu.Lock()
+        ignored := t.gaps.ignored[other]
+        s := t.gaps.statuses[other]
+        var changed <-chan struct{} = t.gaps.changed
+        t.gaps.mu.Unlock()
+
+        if ignored {
+            return false
+        }
+        if s != nil {
+            changed = s.Changed()
+            if s.Cancelled() {
+                return false
+            }
+            if ok, known := s.Lookup(number); known {
+                return !ok
+            }
+            //the other track is shorter, nothing to cut
+            if s.Ended() && number >= s.Total() {
+                return false
+            }
+        }
+
+        t.log().Debugf("Waiting for %s segment %d before merging", other, number)
+        <-changed
+    }
+}
+
+// timestamps of the first frame of a segment file and of the end of its
+// last frame
+func segmentTimes(path string) (int64, int64, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return 0, 0, err
+    }
+    frames, err := newSegmentDemuxer(data).demux(data)
+    if err != nil {
+        return 0, 0, err
+    }
+    if len(frames) == 0 {
+        return 0, 0, fmt.Errorf("No frames found")
+    }
+    first := frames[0].timestamp
+    last := frames[len(frames) - 1].timestamp
+    if len(frames) > 1 {
+        last += last - frames[len(frames) - 2].timestamp
+    }
+    return first, last, nil
+}
+
+// hls.js uses the same frames, see its aac-helper
+var silentAacFrames = map[uint64][]byte {
+    1: { 0x00, 0xC8, 0x00, 0x80, 0x23, 0x80 },
+    2: { 0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80 },
+}
+
+// a 20ms opus packet (celt, fullband, mono) that decodes to silence
+var silentOpusFrame = []byte { 0xF8, 0xFF, 0xFE }
+
+// returns a frame of silence for the track's codec and its duration in
+// nanoseconds, or nil if the codec isn't supported
+func silentAudioFrame(info *mkvTrackInfo) ([]byte, int64) {
+    switch info.codecID {
+    case "A_OPUS":
+        return silentOpusFrame, int64(20 * time.Millisecond)
+    case "A_AAC":
+        //audio object type 2, aac-lc
+        if len(info.codecPrivate) == 0 || info.codecPrivate[0] >> 3 != 2 || info.samplingRate <= 0 {
+            return nil, 0
+        }
+        frame, ok := silentAacFrames[info.channels]
+        if !ok {
+            return nil, 0
+        }
+        return frame, int64(1024 * float64(time.Second) / info.samplingRate)
+    }
+    return nil, 0
+}
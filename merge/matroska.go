@@ -0,0 +1,566 @@
+package merge
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+)
+
+// element IDs, see https://www.matroska.org/technical/elements.html
+const (
+    mkvEBML               = 0x1A45DFA3
+    mkvEBMLVersion        = 0x4286
+    mkvEBMLReadVersion    = 0x42F7
+    mkvEBMLMaxIDLength    = 0x42F2
+    mkvEBMLMaxSizeLength  = 0x42F3
+    mkvDocType            = 0x4282
+    mkvDocTypeVersion     = 0x4287
+    mkvDocTypeReadVersion = 0x4285
+    mkvVoid               = 0xEC
+
+    mkvSegment            = 0x18538067
+    mkvSeekHead           = 0x114D9B74
+    mkvSeek               = 0x4DBB
+    mkvSeekID             = 0x53AB
+    mkvSeekPosition       = 0x53AC
+
+    mkvInfo               = 0x1549A966
+    mkvTimestampScale     = 0x2AD7B1
+    mkvDuration           = 0x4489
+    mkvMuxingApp          = 0x4D80
+    mkvWritingApp         = 0x5741
+    mkvTitle              = 0x7BA9
+
+    mkvTracks             = 0x1654AE6B
+    mkvTrackEntry         = 0xAE
+    mkvTrackNumber        = 0xD7
+    mkvTrackUID           = 0x73C5
+    mkvTrackType          = 0x83
+    mkvFlagLacing         = 0x9C
+    mkvCodecID            = 0x86
+    mkvCodecPrivate       = 0x63A2
+    mkvDefaultDuration    = 0x23E383
+    mkvCodecDelay         = 0x56AA
+    mkvSeekPreRoll        = 0x56BB
+    mkvVideo              = 0xE0
+    mkvPixelWidth         = 0xB0
+    mkvPixelHeight        = 0xBA
+    mkvAudio              = 0xE1
+    mkvSamplingFrequency  = 0xB5
+    mkvChannels           = 0x9F
+    mkvBitDepth           = 0x6264
+
+    mkvCluster            = 0x1F43B675
+    mkvTimestamp          = 0xE7
+    mkvSimpleBlock        = 0xA3
+    mkvBlockGroup         = 0xA0
+    mkvBlock              = 0xA1
+    mkvReferenceBlock     = 0xFB
+
+    mkvCues               = 0x1C53BB6B
+    mkvCuePoint           = 0xBB
+    mkvCueTime            = 0xB3
+    mkvCueTrackPositions  = 0xB7
+    mkvCueTrack           = 0xF7
+    mkvCueClusterPosition = 0xF1
+
+    mkvAttachments        = 0x1941A469
+    mkvAttachedFile       = 0x61A7
+    mkvFileName           = 0x466E
+    mkvFileMimeType       = 0x4660
+    mkvFileData           = 0x465C
+    mkvFileUID            = 0x46AE
+
+    mkvTags               = 0x1254C367
+    mkvTag                = 0x7373
+    mkvTargets            = 0x63C0
+    mkvSimpleTag          = 0x67C8
+    mkvTagName            = 0x45A3
+    mkvTagString          = 0x4487
+
+    mkvChapters           = 0x1043A770
+    mkvEditionEntry       = 0x45B9
+    mkvChapterAtom        = 0xB6
+    mkvChapterUID         = 0x73C4
+    mkvChapterTimeStart   = 0x91
+    mkvChapterTimeEnd     = 0x92
+    mkvChapterDisplay     = 0x80
+    mkvChapString         = 0x85
+    mkvChapLanguage       = 0x437C
+)
+
+const (
+    mkvTrackTypeVideo = 1
+    mkvTrackTypeAudio = 2
+)
+
+// size of the space reserved for the seek head at the start of the segment
+const mkvSeekHeadReserved = 160
+
+// ebml element builder, elements are written to the buffer as they're added
+type ebmlBuffer struct {
+    bytes.Buffer
+}
+
+func ebmlIDLength(id uint32) int {
+    switch {
+    case id <= 0xFF:
+        return 1
+    case id <= 0xFFFF:
+        return 2
+    case id <= 0xFFFFFF:
+        return 3
+    default:
+        return 4
+    }
+}
+
+func (b *ebmlBuffer) writeID(id uint32) {
+    for i := ebmlIDLength(id) - 1; i >= 0; i-- {
+        b.WriteByte(byte(id >> (8 * i)))
+    }
+}
+
+func (b *ebmlBuffer) writeSize(size uint64) {
+    length := 1
+    //all ones is reserved for unknown sizes
+    for size >= (1 << (7 * length)) - 1 {
+        length++
+    }
+    v := size | (1 << (7 * length))
+    for i := length - 1; i >= 0; i-- {
+        b.WriteByte(byte(v >> (8 * i)))
+    }
+}
+
+func (b *ebmlBuffer) binary(id uint32, data []byte) {
+    b.writeID(id)
+    b.writeSize(uint64(len(data)))
+    b.Write(data)
+}
+
+func (b *ebmlBuffer) string(id uint32, s string) {
+    b.binary(id, []byte(s))
+}
+
+func (b *ebmlBuffer) uint(id uint32, v uint64) {
+    length := 1
+    for length < 8 && v >= (1 << (8 * length)) {
+        length++
+    }
+    b.writeID(id)
+    b.writeSize(uint64(length))
+    for i := length - 1; i >= 0; i-- {
+        b.WriteByte(byte(v >> (8 * i)))
+    }
+}
+
+func (b *ebmlBuffer) float(id uint32, v float64) {
+    var data [8]byte
+    binary.BigEndian.PutUint64(data[:], math.Float64bits(v))
+    b.binary(id, data[:])
+}
+
+func (b *ebmlBuffer) master(id uint32, f func(*ebmlBuffer)) {
+    var child ebmlBuffer
+    f(&child)
+    b.binary(id, child.Bytes())
+}
+
+// fills exactly size bytes with a void element
+func (b *ebmlBuffer) void(size int) {
+    if size < 2 {
+        panic(fmt.Sprintf("Void element needs at least 2 bytes, got %d", size))
+    }
+    //size field is fixed to 8 bytes to make the math simple
+    if size < 9 {
+        b.writeID(mkvVoid)
+        b.writeSize(uint64(size - 2))
+        b.Write(make([]byte, size - 2))
+        return
+    }
+    b.writeID(mkvVoid)
+    var sz [8]byte
+    binary.BigEndian.PutUint64(sz[:], uint64(size - 9))
+    sz[0] = 0x01
+    b.Write(sz[:])
+    b.Write(make([]byte, size - 9))
+}
+
+type mkvTrackInfo struct {
+    audio           bool
+    codecID         string
+    codecPrivate    []byte
+    codecDelay      uint64
+    seekPreRoll     uint64
+    defaultDuration uint64
+    width           uint64
+    height          uint64
+    samplingRate    float64
+    channels        uint64
+    bitDepth        uint64
+}
+
+type mkvFrame struct {
+    // presentation timestamp, in nanoseconds
+    timestamp int64
+    keyframe  bool
+    // lacing/invisible/discardable flags of webm blocks, kept as is
+    flags     byte
+    data      []byte
+}
+
+type metadataTag struct {
+    name  string
+    value string
+}
+
+type mkvCue struct {
+    time     uint64
+    track    uint64
+    position uint64
+}
+
+// writes a matroska file with timestamps in milliseconds. the output must be
+// seekable so sizes and positions can be filled in once everything is written
+type mkvWriter struct {
+    out            io.WriteSeeker
+    pos            int64
+    segmentStart   int64
+    seekHeadPos    int64
+    durationPos    int64
+    infoPos        int64
+    tracksPos      int64
+    attachmentsPos int64
+    tagsPos        int64
+    cues           []mkvCue
+    duration       int64
+    cueTrack       uint64
+    videoTrack     uint64
+
+    cluster        ebmlBuffer
+    clusterTime    int64
+    clusterOpen    bool
+    clusterFrames  int
+}
+
+func (w *mkvWriter) write(data []byte) error {
+    n, err := w.out.Write(data)
+    w.pos += int64(n)
+    return err
+}
+
+func (w *mkvWriter) writeHeader(title string, tracks []*mkvTrackInfo, attachment []byte, tags []metadataTag) error {
+    var b ebmlBuffer
+    b.master(mkvEBML, func(b *ebmlBuffer) {
+        b.uint(mkvEBMLVersion, 1)
+        b.uint(mkvEBMLReadVersion, 1)
+        b.uint(mkvEBMLMaxIDLength, 4)
+        b.uint(mkvEBMLMaxSizeLength, 8)
+        b.string(mkvDocType, "matroska")
+        b.uint(mkvDocTypeVersion, 4)
+        b.uint(mkvDocTypeReadVersion, 2)
+    })
+    b.writeID(mkvSegment)
+    //size gets patched once done
+    b.Write([]byte { 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF })
+    if err := w.write(b.Bytes()); err != nil {
+        return err
+    }
+    w.segmentStart = w.pos
+
+    b.Reset()
+    b.void(mkvSeekHeadReserved)
+    w.seekHeadPos = w.pos
+    if err := w.write(b.Bytes()); err != nil {
+        return err
+    }
+
+    b.Reset()
+    w.infoPos = w.pos
+    b.master(mkvInfo, func(b *ebmlBuffer) {
+        b.uint(mkvTimestampScale, 1000000)
+        b.string(mkvMuxingApp, "ytarchive-raw-go")
+        b.string(mkvWritingApp, "ytarchive-raw-go")
+        if title != "" {
+            b.string(mkvTitle, title)
+        }
+        //float is always the last 8 bytes
+        b.float(mkvDuration, 0)
+    })
+    w.durationPos = w.pos + int64(b.Len()) - 8
+    if err := w.write(b.Bytes()); err != nil {
+        return err
+    }
+
+    b.Reset()
+    w.tracksPos = w.pos
+    b.master(mkvTracks, func(b *ebmlBuffer) {
+        for i, t := range tracks {
+            number := uint64(i + 1)
+            if !t.audio {
+                w.videoTrack = number
+            }
+            b.master(mkvTrackEntry, func(b *ebmlBuffer) {
+                b.uint(mkvTrackNumber, number)
+                b.uint(mkvTrackUID, number)
+                b.uint(mkvFlagLacing, 0)
+                b.string(mkvCodecID, t.codecID)
+                if len(t.codecPrivate) > 0 {
+                    b.binary(mkvCodecPrivate, t.codecPrivate)
+                }
+                if t.defaultDuration > 0 {
+                    b.uint(mkvDefaultDuration, t.defaultDuration)
+                }
+                if t.codecDelay > 0 {
+                    b.uint(mkvCodecDelay, t.codecDelay)
+                }
+                if t.seekPreRoll > 0 {
+                    b.uint(mkvSeekPreRoll, t.seekPreRoll)
+                }
+                if t.audio {
+                    b.uint(mkvTrackType, mkvTrackTypeAudio)
+                    b.master(mkvAudio, func(b *ebmlBuffer) {
+                        b.float(mkvSamplingFrequency, t.samplingRate)
+                        b.uint(mkvChannels, t.channels)
+                        if t.bitDepth > 0 {
+                            b.uint(mkvBitDepth, t.bitDepth)
+                        }
+                    })
+                } else {
+                    b.uint(mkvTrackType, mkvTrackTypeVideo)
+                    b.master(mkvVideo, func(b *ebmlBuffer) {
+                        b.uint(mkvPixelWidth, t.width)
+                        b.uint(mkvPixelHeight, t.height)
+                    })
+                }
+            })
+        }
+    })
+    if w.videoTrack != 0 {
+        w.cueTrack = w.videoTrack
+    } else {
+        w.cueTrack = 1
+    }
+    if err := w.write(b.Bytes()); err != nil {
+        return err
+    }
+
+    if attachment != nil {
+        b.Reset()
+        w.attachmentsPos = w.pos
+        b.master(mkvAttachments, func(b *ebmlBuffer) {
+            b.master(mkvAttachedFile, func(b *ebmlBuffer) {
+                b.string(mkvFileName, "thumbnail.jpg")
+                b.string(mkvFileMimeType, "image/jpeg")
+                b.binary(mkvFileData, attachment)
+                b.uint(mkvFileUID, 1)
+            })
+        })
+        if err := w.write(b.Bytes()); err != nil {
+            return err
+        }
+    }
+
+    if len(tags) > 0 {
+        b.Reset()
+        w.tagsPos = w.pos
+        b.master(mkvTags, func(b *ebmlBuffer) {
+            b.master(mkvTag, func(b *ebmlBuffer) {
+                b.master(mkvTargets, func(b *ebmlBuffer) {})
+                for _, t := range tags {
+                    b.master(mkvSimpleTag, func(b *ebmlBuffer) {
+                        b.string(mkvTagName, t.name)
+                        b.string(mkvTagString, t.value)
+                    })
+                }
+            })
+        })
+        if err := w.write(b.Bytes()); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (w *mkvWriter) flushCluster() error {
+    if !w.clusterOpen {
+        return nil
+    }
+    var b ebmlBuffer
+    b.writeID(mkvCluster)
+    b.writeSize(uint64(w.cluster.Len()))
+    w.clusterOpen = false
+    if err := w.write(b.Bytes()); err != nil {
+        return err
+    }
+    return w.write(w.cluster.Bytes())
+}
+
+// frames must be written in (roughly) increasing timestamp order
+func (w *mkvWriter) writeFrame(track uint64, frame *mkvFrame) error {
+    ts := frame.timestamp / 1000000
+    if ts < 0 {
+        ts = 0
+    }
+
+    newCluster := !w.clusterOpen
+    if w.clusterOpen {
+        rel := ts - w.clusterTime
+        if rel > math.MaxInt16 || rel < math.MinInt16 {
+            newCluster = true
+        } else if w.videoTrack != 0 {
+            //start clusters on video keyframes so the cues can point at them
+            newCluster = track == w.videoTrack && frame.keyframe && w.clusterFrames > 0
+        } else {
+            newCluster = rel >= 5000
+        }
+    }
+    if newCluster {
+        if err := w.flushCluster(); err != nil {
+            return err
+        }
+        w.cluster.Reset()
+        w.cluster.uint(mkvTimestamp, uint64(ts))
+        w.clusterTime = ts
+        w.clusterOpen = true
+        w.clusterFrames = 0
+        if track == w.cueTrack && frame.keyframe {
+            w.cues = append(w.cues, mkvCue {
+                time:     uint64(ts),
+                track:    track,
+                position: uint64(w.pos - w.segmentStart),
+            })
+        }
+    }
+
+    flags := frame.flags & 0x0F
+    if frame.keyframe {
+        flags |= 0x80
+    }
+    rel := int16(ts - w.clusterTime)
+
+    var header ebmlBuffer
+    header.writeSize(track)
+    header.WriteByte(byte(uint16(rel) >> 8))
+    header.WriteByte(byte(uint16(rel)))
+    header.WriteByte(flags)
+
+    w.cluster.writeID(mkvSimpleBlock)
+    w.cluster.writeSize(uint64(header.Len() + len(frame.data)))
+    w.cluster.Write(header.Bytes())
+    w.cluster.Write(frame.data)
+    w.clusterFrames++
+
+    if ts > w.duration {
+        w.duration = ts
+    }
+    return nil
+}
+
+// writes the chapters and cues and fills in the seek head, duration and
+// segment size. chapter times are in nanoseconds.
+func (w *mkvWriter) finish(chapters []mkvChapter) error {
+    if err := w.flushCluster(); err != nil {
+        return err
+    }
+
+    var b ebmlBuffer
+    chaptersPos := int64(-1)
+    if len(chapters) > 0 {
+        chaptersPos = w.pos
+        b.master(mkvChapters, func(b *ebmlBuffer) {
+            b.master(mkvEditionEntry, func(b *ebmlBuffer) {
+                for i, c := range chapters {
+                    b.master(mkvChapterAtom, func(b *ebmlBuffer) {
+                        b.uint(mkvChapterUID, uint64(i + 1))
+                        b.uint(mkvChapterTimeStart, uint64(c.start))
+                        b.uint(mkvChapterTimeEnd, uint64(c.end))
+                        b.master(mkvChapterDisplay, func(b *ebmlBuffer) {
+                            b.string(mkvChapString, c.title)
+                            b.string(mkvChapLanguage, "eng")
+                        })
+                    })
+                }
+            })
+        })
+        if err := w.write(b.Bytes()); err != nil {
+            return err
+        }
+    }
+
+    b.Reset()
+    cuesPos := int64(-1)
+    if len(w.cues) > 0 {
+        cuesPos = w.pos
+        b.master(mkvCues, func(b *ebmlBuffer) {
+            for _, c := range w.cues {
+                b.master(mkvCuePoint, func(b *ebmlBuffer) {
+                    b.uint(mkvCueTime, c.time)
+                    b.master(mkvCueTrackPositions, func(b *ebmlBuffer) {
+                        b.uint(mkvCueTrack, c.track)
+                        b.uint(mkvCueClusterPosition, c.position)
+                    })
+                })
+            }
+        })
+        if err := w.write(b.Bytes()); err != nil {
+            return err
+        }
+    }
+    end := w.pos
+
+    b.Reset()
+    b.master(mkvSeekHead, func(b *ebmlBuffer) {
+        seek := func(id uint32, pos int64) {
+            if pos <= 0 {
+                return
+            }
+            var idBuf ebmlBuffer
+            idBuf.writeID(id)
+            b.master(mkvSeek, func(b *ebmlBuffer) {
+                b.binary(mkvSeekID, idBuf.Bytes())
+                b.uint(mkvSeekPosition, uint64(pos - w.segmentStart))
+            })
+        }
+        seek(mkvInfo, w.infoPos)
+        seek(mkvTracks, w.tracksPos)
+        seek(mkvAttachments, w.attachmentsPos)
+        seek(mkvTags, w.tagsPos)
+        seek(mkvChapters, chaptersPos)
+        seek(mkvCues, cuesPos)
+    })
+    if b.Len() > mkvSeekHeadReserved - 2 {
+        return fmt.Errorf("Seek head too big (%d bytes)", b.Len())
+    }
+    b.void(mkvSeekHeadReserved - b.Len())
+    if err := w.patch(w.seekHeadPos, b.Bytes()); err != nil {
+        return err
+    }
+
+    var duration [8]byte
+    binary.BigEndian.PutUint64(duration[:], math.Float64bits(float64(w.duration)))
+    if err := w.patch(w.durationPos, duration[:]); err != nil {
+        return err
+    }
+
+    var size [8]byte
+    binary.BigEndian.PutUint64(size[:], uint64(end - w.segmentStart))
+    size[0] = 0x01
+    if err := w.patch(w.segmentStart - 8, size[:]); err != nil {
+        return err
+    }
+
+    _, err := w.out.Seek(end, io.SeekStart)
+    return err
+}
+
+func (w *mkvWriter) patch(pos int64, data []byte) error {
+    if _, err := w.out.Seek(pos, io.SeekStart); err != nil {
+        return err
+    }
+    _, err := w.out.Write(data)
+    return err
+}
@@ -1,6 +1,7 @@
 package merge
 
 import (
+    "context"
     "fmt"
     "os"
     "strings"
@@ -24,17 +25,50 @@ type Muxer interface {
 }
 
 func CreateBestMuxer(opts *MuxerOptions) (Muxer, error) {
-    if err := testFfmpeg(); err != nil {
-        return nil, fmt.Errorf("Unable to find FFmpeg: %v", err)
-    }
-
     if opts.IgnoreAudio && opts.IgnoreVideo {
         return nil, fmt.Errorf("Ignoring both audio and video")
     }
 
-    switch strings.ToLower(opts.Merger) {
+    //tcp streams segments to ffmpeg before gaps are known, and only the
+    //native merger can write filler frames
+    merger := strings.ToLower(opts.Merger)
+    if opts.GapPolicy == GapFill || opts.GapPolicy == GapMarker {
+        switch merger {
+        case "":
+            opts.Logger.Infof("Using native muxer for gap policy '%v'", opts.GapPolicy)
+            return CreateNativeMuxer(opts)
+        case "tcp":
+            return nil, fmt.Errorf("Gap policy '%v' is not supported by the tcp merger", opts.GapPolicy)
+        case "concat":
+            if opts.GapPolicy == GapFill {
+                return nil, fmt.Errorf("Gap policy 'fill' is only supported by the native merger")
+            }
+        }
+    }
+
+    //mergers that don't need ffmpeg
+    switch merger {
     case "download-only":
+        if opts.TempBudget != nil {
+            return nil, fmt.Errorf("The download-only merger keeps every segment, so it can't stay within a temp size limit")
+        }
+        if opts.ClipStart > 0 || opts.ClipEnd > 0 {
+            opts.Logger.Warn("The download-only merger doesn't trim the output, only the segments around the clip are downloaded")
+        }
         return CreateDownloadOnlyMuxer(opts)
+    case "native":
+        return CreateNativeMuxer(opts)
+    }
+
+    if err := testFfmpeg(); err != nil {
+        if opts.Merger == "" {
+            opts.Logger.Warnf("Unable to find FFmpeg (%v), using native muxer", err)
+            return CreateNativeMuxer(opts)
+        }
+        return nil, fmt.Errorf("Unable to find FFmpeg: %v", err)
+    }
+
+    switch merger {
     case "tcp":
         return CreateTcpMuxer(opts)
     case "concat":
@@ -67,6 +101,14 @@ func MergeNothing(m Merger) {
 }
 
 type MuxerOptions struct {
+    // where the output ends, relative to the first merged frame. 0 to keep
+    // everything until the end
+    ClipEnd         time.Duration
+    // where the output starts, relative to the first merged frame. without
+    // reencoding, video can only start at a keyframe next to it
+    ClipStart       time.Duration
+    // cancels merging and muxing, may be nil
+    Context         context.Context
     // should segments be deleted after successfully muxing?
     DeleteSegments  bool
     // should segments be deleted after merging?
@@ -84,12 +126,32 @@ type MuxerOptions struct {
     Merger          string
     // arguments for the mergers
     MergerArguments map[string]map[string]string
+    // called with the merged audio and video segment counts and the total
+    // segments per track whenever they change, may be nil
+    OnProgress      func(audio, video, total int)
     // if temporary files already exist, should they be overwritten?
     OverwriteTemp   bool
+    // what to do about segments that couldn't be downloaded
+    GapPolicy       GapPolicy
+    // counts downloaded segments against a size limit. segments are deleted
+    // as they're merged if set, to free space for more. may be nil
+    TempBudget      *util.DiskBudget
     // directory to store temporary files
     TempDir         string
 }
 
+func (opts *MuxerOptions) context() context.Context {
+    if opts.Context == nil {
+        return context.Background()
+    }
+    return opts.Context
+}
+
+// whether segments should be deleted as soon as they're merged
+func (opts *MuxerOptions) deleteMerged() bool {
+    return opts.DisableResume || opts.TempBudget != nil
+}
+
 func (opts *MuxerOptions) getMergerArgument(name, arg string) (string, bool) {
     m, ok := opts.MergerArguments[strings.ToLower(name)]
     if !ok {
@@ -100,7 +162,10 @@ func (opts *MuxerOptions) getMergerArgument(name, arg string) (string, bool) {
 }
 
 type taskCommon struct {
+    // segments left out because the other track lost them
+    cut         []string
     ffmpegInput string
+    gaps        *gapTracker
     _logger     *log.Logger
     options     *MuxerOptions
     progress    *mergeProgress
@@ -119,6 +184,11 @@ func (t* taskCommon) ignored() bool {
     return (t.which == "audio" && t.options.IgnoreAudio) || (t.which == "video" && t.options.IgnoreVideo)
 }
 
+// deletes a merged segment, freeing its space in the temp budget
+func (t* taskCommon) removeSegment(path string) {
+    t.options.TempBudget.Remove(path)
+}
+
 func (t* taskCommon) output() string {
     if t.ignored() {
         return ""
@@ -134,26 +204,35 @@ func (t* taskCommon) do(f func()) {
 
 func (t* taskCommon) forEachSegment(s *segments.SegmentStatus, f func(segments.SegmentResult)) {
     if t.ignored() {
+        t.gaps.ignore(t.which)
         t.progress.initTotal(0)
         return
     }
 
+    t.gaps.track(t.which, s)
     t.progress.initTotal(s.Total())
-    misses := 0
     for {
-        if s.Done() {
+        result, number, ok := s.WaitNextToMerge(func(number int) {
+            t.log().Debugf("Waiting for segment %d to be ready for merging", number)
+            t.progress.waiting(t.which, number)
+        })
+        if !ok {
             break
         }
-        result, number, done := s.NextToMerge()
-        if !done {
-            t.log().Debugf("Waiting for segment %d to be ready for merging", number)
-            if misses < 10 {
-                misses++
+
+        if !s.Ended() {
+            t.progress.grow(s.Total())
+        }
+
+        if t.options.GapPolicy == GapCut && result.Ok && t.otherLost(number) {
+            t.log().Infof("Leaving out segment %d, the %s track lost it", number, otherTrack(t.which))
+            if t.options.deleteMerged() {
+                t.removeSegment(result.Filename)
+            } else {
+                t.cut = append(t.cut, result.Filename)
             }
-            time.Sleep(time.Duration(misses) * time.Second)
-            continue
+            result.Ok = false
         }
-        misses = 0
 
         f(result)
 
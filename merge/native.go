@@ -0,0 +1,427 @@
+package merge
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/download/segments"
+)
+
+type segmentDemuxer interface {
+    // returns the frames in a segment, with timestamps continuing from
+    // previous segments
+    demux(data []byte) ([]mkvFrame, error)
+    // nil until a segment with track information has been demuxed
+    trackInfo() *mkvTrackInfo
+}
+
+func newSegmentDemuxer(data []byte) segmentDemuxer {
+    if len(data) >= 4 && binary.BigEndian.Uint32(data) == mkvEBML {
+        return newWebmDemuxer()
+    }
+    return newMp4Demuxer()
+}
+
+// Muxes segments into a matroska file without using ffmpeg. Segments are
+// muxed as they're downloaded, so the file is done shortly after downloading
+// finishes.
+var _ Muxer = &NativeMuxer {}
+type NativeMuxer struct {
+    opts        *MuxerOptions
+    progress    *mergeProgress
+    audioMerger *nativeTask
+    videoMerger *nativeTask
+}
+
+func CreateNativeMuxer(options *MuxerOptions) (Muxer, error) {
+    progress := newProgress(options.OnProgress)
+    gaps := newGapTracker()
+    return &NativeMuxer {
+        opts:        options,
+        progress:    progress,
+        audioMerger: createNativeTask(options, progress, gaps, "audio"),
+        videoMerger: createNativeTask(options, progress, gaps, "video"),
+    }, nil
+}
+
+func (m *NativeMuxer) AudioMerger() Merger {
+    return m.audioMerger
+}
+
+func (m *NativeMuxer) VideoMerger() Merger {
+    return m.videoMerger
+}
+
+func (m *NativeMuxer) Mux() error {
+    ctx := m.opts.context()
+    var tasks []*nativeTask
+    var tracks []*mkvTrackInfo
+    for _, t := range []*nativeTask { m.audioMerger, m.videoMerger } {
+        if t.ignored() {
+            continue
+        }
+        if t.peek() == nil {
+            if err := ctx.Err(); err != nil {
+                return err
+            }
+            t.log().Warnf("No %s segments could be read, leaving it out of the output", t.which)
+            continue
+        }
+        tasks = append(tasks, t)
+        tracks = append(tracks, t.demuxer.trackInfo())
+    }
+    if len(tasks) == 0 {
+        return fmt.Errorf("No audio or video segments could be read")
+    }
+
+    //make the output start at 0
+    offset := firstTimestamp(tasks)
+    clipEnd := int64(-1)
+    if m.opts.ClipEnd > 0 {
+        clipEnd = offset + int64(m.opts.ClipEnd)
+    }
+    if m.opts.ClipStart > 0 {
+        //video first, audio then starts along with it
+        start := offset + int64(m.opts.ClipStart)
+        for _, t := range tasks {
+            if !t.demuxer.trackInfo().audio {
+                if ts := t.skipTo(start); ts >= 0 && ts < start {
+                    start = ts
+                }
+            }
+        }
+        for _, t := range tasks {
+            if t.demuxer.trackInfo().audio {
+                t.skipTo(start)
+            }
+        }
+        offset = firstTimestamp(tasks)
+        if offset < 0 {
+            return fmt.Errorf("Nothing to mux after %v", m.opts.ClipStart)
+        }
+    }
+
+    thumbnail := m.opts.FinalFileBase + ".jpg"
+    if err := m.opts.FregData.WriteThumbnail(thumbnail); err != nil {
+        return fmt.Errorf("Unable to write thumbnail file: %v", err)
+    }
+    thumbnailData, err := m.opts.FregData.ThumbnailData()
+    if err != nil {
+        return fmt.Errorf("Unable to decode thumbnail: %v", err)
+    }
+
+    //same tags ffmpeg writes for the other mergers
+    var title string
+    var tags []metadataTag
+    for _, tag := range outputMetadata(m.opts.FregData) {
+        if tag.name == "title" {
+            title = tag.value
+            continue
+        }
+        tags = append(tags, metadataTag {
+            name:  strings.ToUpper(tag.name),
+            value: tag.value,
+        })
+    }
+
+    file, err := os.OpenFile(m.OutputFilePath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return fmt.Errorf("Unable to create output file: %v", err)
+    }
+    defer file.Close()
+
+    w := &mkvWriter { out: file }
+    if err = w.writeHeader(title, tracks, thumbnailData, tags); err != nil {
+        return fmt.Errorf("Unable to write output file: %v", err)
+    }
+
+    for {
+        if ctx.Err() != nil {
+            break
+        }
+        next := -1
+        var frame *mkvFrame
+        for i, t := range tasks {
+            if f := t.peek(); f != nil && (frame == nil || f.timestamp < frame.timestamp) {
+                next = i
+                frame = f
+            }
+        }
+        if frame == nil {
+            break
+        }
+        if clipEnd >= 0 && frame.timestamp >= clipEnd {
+            for _, t := range tasks {
+                t.drain()
+            }
+            break
+        }
+        f := *frame
+        f.timestamp -= offset
+        if err = w.writeFrame(uint64(next + 1), &f); err != nil {
+            return fmt.Errorf("Unable to write output file: %v", err)
+        }
+        tasks[next].pop()
+    }
+    //the mergers also stop early when cancelled, so the file would be
+    //missing the rest of the video
+    if err = ctx.Err(); err != nil {
+        file.Close()
+        os.Remove(m.OutputFilePath())
+        return err
+    }
+
+    var chapters []mkvChapter
+    for _, t := range tasks {
+        for _, c := range t.chapters {
+            c.start -= offset
+            c.end -= offset
+            //leave out the parts that were trimmed
+            if c.end <= 0 || (clipEnd >= 0 && c.start >= clipEnd - offset) {
+                continue
+            }
+            if c.start < 0 {
+                c.start = 0
+            }
+            if clipEnd >= 0 && c.end > clipEnd - offset {
+                c.end = clipEnd - offset
+            }
+            chapters = append(chapters, c)
+        }
+    }
+    sortChapters(chapters)
+
+    if err = w.finish(chapters); err != nil {
+        return fmt.Errorf("Unable to write output file: %v", err)
+    }
+    if err = file.Close(); err != nil {
+        return fmt.Errorf("Unable to close output file: %v", err)
+    }
+    m.progress.done()
+
+    if m.opts.DeleteSegments {
+        deleteSegmentFiles(m.audioMerger.segments)
+        deleteSegmentFiles(m.videoMerger.segments)
+        deleteSegmentFiles(m.audioMerger.cut)
+        deleteSegmentFiles(m.videoMerger.cut)
+    }
+
+    return nil
+}
+
+// returns the lowest timestamp of the next frames of the tasks, -1 if they
+// have no frames left
+func firstTimestamp(tasks []*nativeTask) int64 {
+    first := int64(-1)
+    for _, t := range tasks {
+        if f := t.peek(); f != nil && (first < 0 || f.timestamp < first) {
+            first = f.timestamp
+        }
+    }
+    return first
+}
+
+func (m *NativeMuxer) OutputFilePath() string {
+    return m.opts.FinalFileBase + ".mkv"
+}
+
+var _ Merger = &nativeTask {}
+type nativeTask struct {
+    taskCommon
+    chapters       []mkvChapter
+    deleteSegments bool
+    demuxer        segmentDemuxer
+    frames         []mkvFrame
+    results        chan segments.SegmentResult
+    segments       []string
+
+    // for gap handling
+    hasLast        bool
+    lastEnd        int64
+    lastKeyframe   []byte
+    lastTimestamp  int64
+    lost           int
+}
+
+func createNativeTask(options *MuxerOptions, progress *mergeProgress, gaps *gapTracker, which string) *nativeTask {
+    return &nativeTask {
+        taskCommon:     taskCommon {
+            gaps:        gaps,
+            options:     options,
+            progress:    progress,
+            which:       which,
+        },
+        deleteSegments: options.deleteMerged(),
+        results:        make(chan segments.SegmentResult),
+    }
+}
+
+func (t *nativeTask) Merge(status *segments.SegmentStatus) {
+    defer close(t.results)
+
+    //hand segments over one by one, so merge progress follows the muxer
+    ctx := t.options.context()
+    t.forEachSegment(status, func(result segments.SegmentResult) {
+        select {
+        case t.results <- result:
+        case <-ctx.Done():
+        }
+    })
+}
+
+// returns the next frame without consuming it, reading more segments as
+// needed. returns nil once all segments have been consumed.
+func (t *nativeTask) peek() *mkvFrame {
+    for len(t.frames) == 0 {
+        result, ok := <-t.results
+        if !ok {
+            return nil
+        }
+        if result.Ok {
+            t.load(result.Filename)
+        }
+        if len(t.frames) == 0 {
+            t.lost++
+        } else if t.lost > 0 {
+            t.fillGap()
+        }
+    }
+    return &t.frames[0]
+}
+
+func (t *nativeTask) pop() {
+    f := &t.frames[0]
+    //assume the frame lasts as long as the previous one
+    if t.hasLast && f.timestamp > t.lastTimestamp {
+        t.lastEnd = f.timestamp + (f.timestamp - t.lastTimestamp)
+    } else {
+        t.lastEnd = f.timestamp
+    }
+    t.lastTimestamp = f.timestamp
+    t.hasLast = true
+    if f.keyframe && !t.demuxer.trackInfo().audio {
+        t.lastKeyframe = f.data
+    }
+    t.frames[0] = mkvFrame {}
+    t.frames = t.frames[1:]
+}
+
+// drops the frames before ts. for video, frames from the last keyframe before
+// ts are kept so playback can start there. returns the timestamp of the next
+// frame, -1 if there are none left
+func (t *nativeTask) skipTo(ts int64) int64 {
+    video := !t.demuxer.trackInfo().audio
+    var gop []mkvFrame
+    for {
+        f := t.peek()
+        if f == nil || f.timestamp >= ts {
+            break
+        }
+        if video && f.keyframe {
+            gop = nil
+        }
+        if video && (gop != nil || f.keyframe) {
+            gop = append(gop, *f)
+        }
+        t.pop()
+    }
+    //gaps before the start don't show up in the output either
+    t.hasLast = false
+    if len(gop) > 0 && (len(t.frames) == 0 || !t.frames[0].keyframe || t.frames[0].timestamp > ts) {
+        t.frames = append(gop, t.frames...)
+    }
+    if f := t.peek(); f != nil {
+        return f.timestamp
+    }
+    return -1
+}
+
+// consumes the remaining segments without demuxing them
+func (t *nativeTask) drain() {
+    t.frames = nil
+    for result := range t.results {
+        if !result.Ok {
+            continue
+        }
+        if t.deleteSegments {
+            t.removeSegment(result.Filename)
+        } else {
+            t.segments = append(t.segments, result.Filename)
+        }
+    }
+}
+
+// handles the gap between the last popped frame and the first loaded one,
+// according to the gap policy
+func (t *nativeTask) fillGap() {
+    lost := t.lost
+    t.lost = 0
+    start := t.lastEnd
+    end := t.frames[0].timestamp
+    //gaps at the start don't show up in the output
+    if !t.hasLast || end <= start {
+        return
+    }
+
+    switch t.options.GapPolicy {
+    case GapMarker:
+        t.chapters = append(t.chapters, mkvChapter {
+            start: start,
+            end:   end,
+            title: gapTitle(t.which, lost),
+        })
+    case GapFill:
+        var filler []mkvFrame
+        if t.demuxer.trackInfo().audio {
+            data, duration := silentAudioFrame(t.demuxer.trackInfo())
+            if data == nil {
+                t.log().Warnf("Unable to fill gap, no silence available for codec %s", t.demuxer.trackInfo().codecID)
+                return
+            }
+            for ts := start; ts + duration <= end; ts += duration {
+                filler = append(filler, mkvFrame {
+                    timestamp: ts,
+                    keyframe:  true,
+                    data:      data,
+                })
+            }
+        } else if t.lastKeyframe != nil {
+            //repeating the last keyframe shows it until the gap ends
+            filler = append(filler, mkvFrame {
+                timestamp: start,
+                keyframe:  true,
+                data:      t.lastKeyframe,
+            })
+        }
+        t.log().Infof("Filling %v gap after %d lost segments", time.Duration(end - start), lost)
+        t.frames = append(filler, t.frames...)
+    }
+}
+
+func (t *nativeTask) load(path string) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.log().Errorf("Unable to read segment '%s': %v", path, err)
+        return
+    }
+
+    if t.demuxer == nil {
+        t.demuxer = newSegmentDemuxer(data)
+    }
+    frames, err := t.demuxer.demux(data)
+    if err != nil {
+        t.log().Errorf("Unable to demux segment '%s': %v", path, err)
+    } else {
+        t.frames = frames
+    }
+
+    if t.deleteSegments {
+        t.removeSegment(path)
+    } else {
+        t.segments = append(t.segments, path)
+    }
+}
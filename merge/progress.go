@@ -14,16 +14,23 @@ const (
 )
 
 type mergeProgress struct {
-    mu    sync.Mutex
-    ended bool
-    total int
-    audio int
-    video int
+    mu           sync.Mutex
+    ended        bool
+    total        int
+    audio        int
+    video        int
+    // segment each track is waiting for, -1 if it isn't
+    audioWaiting int
+    videoWaiting int
+    listener     func(audio, video, total int)
 }
 
-func newProgress() *mergeProgress {
+func newProgress(listener func(audio, video, total int)) *mergeProgress {
     return &mergeProgress {
-        total: -1,
+        total:        -1,
+        audioWaiting: -1,
+        videoWaiting: -1,
+        listener:     listener,
     }
 }
 
@@ -36,6 +43,16 @@ func (m *mergeProgress) initTotal(total int) {
     }
 }
 
+// live streams keep adding segments while merging
+func (m *mergeProgress) grow(total int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if total > m.total {
+        m.total = total
+        m.updated()
+    }
+}
+
 func (m *mergeProgress) done() {
     m.mu.Lock()
     defer m.mu.Unlock()
@@ -63,9 +80,34 @@ func (m *mergeProgress) updated() {
     }
 
     title := fmt.Sprintf("%.1f%%", pct)
-    msg := fmt.Sprintf("%s%.2f%% (%d audio, %d video)%s", color, pct, m.audio, m.video, colorReset)
+    var waiting string
+    if !m.ended {
+        if m.audioWaiting >= 0 {
+            waiting += fmt.Sprintf(", waiting for audio %d", m.audioWaiting)
+        }
+        if m.videoWaiting >= 0 {
+            waiting += fmt.Sprintf(", waiting for video %d", m.videoWaiting)
+        }
+    }
+    msg := fmt.Sprintf("%s%.2f%% (%d audio, %d video%s)%s", color, pct, m.audio, m.video, waiting, colorReset)
 
     log.Progress(log.ProgressMerge, title, msg)
+    if m.listener != nil {
+        m.listener(m.audio, m.video, m.total)
+    }
+}
+
+// a track can't merge more until segment is downloaded
+func (m *mergeProgress) waiting(which string, segment int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if which == "audio" {
+        m.audioWaiting = segment
+    } else {
+        m.videoWaiting = segment
+    }
+    m.updated()
 }
 
 func (m *mergeProgress) mergedAudio() {
@@ -73,6 +115,7 @@ func (m *mergeProgress) mergedAudio() {
     defer m.mu.Unlock()
 
     m.audio++
+    m.audioWaiting = -1
     m.updated()
 }
 
@@ -81,6 +124,7 @@ func (m *mergeProgress) mergedVideo() {
     defer m.mu.Unlock()
 
     m.video++
+    m.videoWaiting = -1
     m.updated()
 }
 
@@ -28,14 +28,15 @@ func CreateTcpMuxer(options *MuxerOptions) (Muxer, error) {
         bindAddress = "127.0.0.1"
     }
 
-    progress := newProgress()
+    progress := newProgress(options.OnProgress)
+    gaps := newGapTracker()
 
-    audioMerger, err := createTcpTask(bindAddress, options, progress, "audio")
+    audioMerger, err := createTcpTask(bindAddress, options, progress, gaps, "audio")
     if err != nil {
         return nil, err
     }
 
-    videoMerger, err := createTcpTask(bindAddress, options, progress, "video")
+    videoMerger, err := createTcpTask(bindAddress, options, progress, gaps, "video")
     if err != nil {
         return nil, err
     }
@@ -57,21 +58,26 @@ func (m *TcpMuxer) VideoMerger() Merger {
 }
 
 func (m *TcpMuxer) Mux() error {
-    if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output()); err != nil {
+    //also unblocks mergers still waiting for ffmpeg to connect on failure
+    defer func() {
+        if m.audioMerger.listener != nil {
+            m.audioMerger.listener.Close()
+        }
+        if m.videoMerger.listener != nil {
+            m.videoMerger.listener.Close()
+        }
+    }()
+
+    if err := muxFfmpeg(m.opts, m.audioMerger.output(), m.videoMerger.output(), nil); err != nil {
         return err
     }
     m.progress.done()
 
-    if m.audioMerger.listener != nil {
-        m.audioMerger.listener.Close()
-    }
-    if m.videoMerger.listener != nil {
-        m.videoMerger.listener.Close()
-    }
-
     if m.opts.DeleteSegments {
         deleteSegmentFiles(m.audioMerger.segments)
         deleteSegmentFiles(m.videoMerger.segments)
+        deleteSegmentFiles(m.audioMerger.cut)
+        deleteSegmentFiles(m.videoMerger.cut)
     }
 
     return nil
@@ -89,14 +95,15 @@ type tcpTask struct {
     segments       []string
 }
 
-func createTcpTask(bindAddress string, options *MuxerOptions, progress *mergeProgress, which string) (*tcpTask, error) {
+func createTcpTask(bindAddress string, options *MuxerOptions, progress *mergeProgress, gaps *gapTracker, which string) (*tcpTask, error) {
     task := &tcpTask {
         taskCommon:     taskCommon {
+            gaps:        gaps,
             options:     options,
             progress:    progress,
             which:       which,
         },
-        deleteSegments: options.DisableResume,
+        deleteSegments: options.deleteMerged(),
     }
 
     if !task.ignored() {
@@ -144,7 +151,7 @@ func (t *tcpTask) Merge(status *segments.SegmentStatus) {
                 t.log().Errorf("Unable to send file '%s' to muxer: %v", result.Filename, err)
             } else {
                 if t.deleteSegments {
-                    os.Remove(result.Filename)
+                    t.removeSegment(result.Filename)
                 } else {
                     t.segments = append(t.segments, result.Filename)
                 }
@@ -0,0 +1,99 @@
+package merge
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "strconv"
+)
+
+// youtube segments embed a block of metadata text near the start of the file
+var sequenceNumberMarker = []byte("Sequence-Number: ")
+
+// how far into the segment to look for the metadata text
+const sequenceNumberSearchLimit = 64 * 1024
+
+// Returns the sequence number embedded in a segment, if any.
+func SegmentSequenceNumber(data []byte) (uint64, bool) {
+    if len(data) > sequenceNumberSearchLimit {
+        data = data[:sequenceNumberSearchLimit]
+    }
+    idx := bytes.Index(data, sequenceNumberMarker)
+    if idx < 0 {
+        return 0, false
+    }
+    data = data[idx + len(sequenceNumberMarker):]
+    end := 0
+    for end < len(data) && data[end] >= '0' && data[end] <= '9' {
+        end++
+    }
+    sq, err := strconv.ParseUint(string(data[:end]), 10, 64)
+    if err != nil {
+        return 0, false
+    }
+    return sq, true
+}
+
+// Checks that a downloaded segment is a complete fragmented MP4 or WebM file
+// containing media data.
+func ValidateSegment(data []byte) error {
+    if len(data) == 0 {
+        return fmt.Errorf("Empty segment")
+    }
+    if len(data) >= 4 && binary.BigEndian.Uint32(data) == mkvEBML {
+        return validateWebm(data)
+    }
+    return validateMp4(data)
+}
+
+func validateMp4(data []byte) error {
+    boxes, err := readMp4Boxes(data)
+    if err != nil {
+        return err
+    }
+    moof := -1
+    for i, box := range boxes {
+        switch box.typ {
+        case "moof":
+            if _, err := readMp4Boxes(box.body); err != nil {
+                return fmt.Errorf("Invalid moof box: %v", err)
+            }
+            moof = i
+        case "mdat":
+            if moof >= 0 {
+                return nil
+            }
+        }
+    }
+    if moof < 0 {
+        return fmt.Errorf("No moof box found")
+    }
+    return fmt.Errorf("No mdat box after moof")
+}
+
+func validateWebm(data []byte) error {
+    clusters := 0
+    blocks := 0
+    err := walkEbml(data, true, func(id uint32, body []byte) (bool, error) {
+        switch id {
+        case mkvSegment, mkvCluster:
+            if id == mkvCluster {
+                clusters++
+            }
+            return true, nil
+        case mkvSimpleBlock, mkvBlockGroup:
+            blocks++
+        }
+        return false, nil
+    })
+    if err != nil {
+        return err
+    }
+    if clusters == 0 {
+        return fmt.Errorf("No clusters found")
+    }
+    if blocks == 0 {
+        return fmt.Errorf("No blocks found")
+    }
+    return nil
+}
@@ -0,0 +1,215 @@
+// Minimal Prometheus metrics, written in the text exposition format without
+// pulling in the client library.
+package metrics
+
+import (
+    "bufio"
+    "fmt"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+type metricType string
+const (
+    typeCounter metricType = "counter"
+    typeGauge   metricType = "gauge"
+)
+
+var registry struct {
+    mu      sync.Mutex
+    metrics []*metric
+}
+
+type series struct {
+    labelValues []string
+    value       float64
+    // computed when scraped if set
+    fn          func() float64
+}
+
+type metric struct {
+    name       string
+    help       string
+    typ        metricType
+    labelNames []string
+    mu         sync.Mutex
+    series     map[string]*series
+}
+
+// A value that only goes up, such as the amount of downloaded segments.
+type Counter struct {
+    m *metric
+}
+
+// A value that can go up and down.
+type Gauge struct {
+    m *metric
+}
+
+func register(name string, help string, typ metricType, labelNames []string) *metric {
+    m := &metric {
+        name:       name,
+        help:       help,
+        typ:        typ,
+        labelNames: labelNames,
+        series:     make(map[string]*series),
+    }
+
+    registry.mu.Lock()
+    defer registry.mu.Unlock()
+    for _, other := range registry.metrics {
+        if other.name == name {
+            panic(fmt.Sprintf("metric %s registered twice", name))
+        }
+    }
+    registry.metrics = append(registry.metrics, m)
+    return m
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+    return &Counter { m: register(name, help, typeCounter, labelNames) }
+}
+
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+    return &Gauge { m: register(name, help, typeGauge, labelNames) }
+}
+
+func (m *metric) get(labelValues []string) *series {
+    if len(labelValues) != len(m.labelNames) {
+        panic(fmt.Sprintf("metric %s has %d labels, got %d values", m.name, len(m.labelNames), len(labelValues)))
+    }
+    key := strings.Join(labelValues, "\x00")
+    s, ok := m.series[key]
+    if !ok {
+        s = &series {
+            labelValues: append([]string(nil), labelValues...),
+        }
+        m.series[key] = s
+    }
+    return s
+}
+
+func (m *metric) remove(labelValues []string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.series, strings.Join(labelValues, "\x00"))
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+    if v < 0 {
+        panic(fmt.Sprintf("counter %s can't decrease", c.m.name))
+    }
+    c.m.mu.Lock()
+    defer c.m.mu.Unlock()
+    c.m.get(labelValues).value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+    g.m.mu.Lock()
+    defer g.m.mu.Unlock()
+    s := g.m.get(labelValues)
+    s.value = v
+    s.fn = nil
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+    g.m.mu.Lock()
+    defer g.m.mu.Unlock()
+    g.m.get(labelValues).value += v
+}
+
+// makes the value get computed by f every time metrics are scraped
+func (g *Gauge) SetFunc(f func() float64, labelValues ...string) {
+    g.m.mu.Lock()
+    defer g.m.mu.Unlock()
+    g.m.get(labelValues).fn = f
+}
+
+// removes the value for the labels, for things that don't exist anymore
+func (g *Gauge) Delete(labelValues ...string) {
+    g.m.remove(labelValues)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatValue(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    case math.IsNaN(v):
+        return "NaN"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w *bufio.Writer) {
+    m.mu.Lock()
+    keys := make([]string, 0, len(m.series))
+    for k := range m.series {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    type sample struct {
+        labelValues []string
+        value       float64
+        fn          func() float64
+    }
+    samples := make([]sample, len(keys))
+    for i, k := range keys {
+        s := m.series[k]
+        samples[i] = sample { s.labelValues, s.value, s.fn }
+    }
+    m.mu.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+    fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+    for _, s := range samples {
+        //called without the lock, it might use other metrics
+        value := s.value
+        if s.fn != nil {
+            value = s.fn()
+        }
+
+        w.WriteString(m.name)
+        if len(m.labelNames) > 0 {
+            w.WriteByte('{')
+            for i, name := range m.labelNames {
+                if i > 0 {
+                    w.WriteByte(',')
+                }
+                fmt.Fprintf(w, `%s="%s"`, name, labelEscaper.Replace(s.labelValues[i]))
+            }
+            w.WriteByte('}')
+        }
+        w.WriteByte(' ')
+        w.WriteString(formatValue(value))
+        w.WriteByte('\n')
+    }
+}
+
+// Serves all registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        registry.mu.Lock()
+        list := append([]*metric(nil), registry.metrics...)
+        registry.mu.Unlock()
+
+        rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        w := bufio.NewWriter(rw)
+        for _, m := range list {
+            m.write(w)
+        }
+        w.Flush()
+    })
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+    "net"
+    "net/http"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+)
+
+// serves metrics in the background, failing right away if the address
+// can't be used
+func startMetricsServer(address string) {
+    l, err := net.Listen("tcp", address)
+    if err != nil {
+        log.Fatalf("Unable to listen for metrics on %s: %v", address, err)
+    }
+
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", metrics.Handler())
+    go func() {
+        if err := http.Serve(l, mux); err != nil {
+            log.Errorf("Metrics server stopped: %v", err)
+        }
+    }()
+    log.Infof("Serving metrics on http://%s/metrics", l.Addr())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// nil unless --progress-format is json
+var progressJSON *jsonProgress
+
+// writes progress as newline delimited JSON, for programs running this one
+type jsonProgress struct {
+    mu  sync.Mutex
+    enc *json.Encoder
+}
+
+type jsonEvent struct {
+    Time         time.Time `json:"time"`
+    VideoID      string    `json:"video_id"`
+    Event        string    `json:"event"`
+    Category     string    `json:"category,omitempty"`
+
+    // segment
+    Segment      *int      `json:"segment,omitempty"`
+    Status       string    `json:"status,omitempty"`
+    Done         *int      `json:"done,omitempty"`
+    Cached       *int      `json:"cached,omitempty"`
+    Lost         *int      `json:"lost,omitempty"`
+    Requeued     *int      `json:"requeued,omitempty"`
+    Live         *bool     `json:"live,omitempty"`
+    ETASeconds   *float64  `json:"eta_seconds,omitempty"`
+    Rate         *float64  `json:"bytes_per_second,omitempty"`
+
+    // merge
+    Audio        *int      `json:"audio,omitempty"`
+    Video        *int      `json:"video,omitempty"`
+
+    // segment, merge and download_finished
+    Total        *int      `json:"total,omitempty"`
+
+    // download_finished
+    LostSegments []int     `json:"lost_segments,omitempty"`
+
+    // result
+    Output       string    `json:"output,omitempty"`
+    Error        string    `json:"error,omitempty"`
+}
+
+func newJSONProgress(fd uint) *jsonProgress {
+    var out io.Writer
+    switch fd {
+    case 1:
+        out = os.Stdout
+    case 2:
+        out = os.Stderr
+    default:
+        out = os.NewFile(uintptr(fd), "progress")
+    }
+    return &jsonProgress {
+        enc: json.NewEncoder(out),
+    }
+}
+
+func (p *jsonProgress) write(e *jsonEvent) {
+    e.Time = time.Now().UTC()
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if err := p.enc.Encode(e); err != nil {
+        log.Warnf("Unable to write progress: %v", err)
+    }
+}
+
+func (p *jsonProgress) segment(id string, which archive.Track, segment int, status string, stats download.ProgressStats) {
+    eta := -1.0
+    if stats.ETA >= 0 {
+        eta = stats.ETA.Seconds()
+    }
+    p.write(&jsonEvent {
+        VideoID:    id,
+        Event:      "segment",
+        Category:   string(which),
+        Segment:    &segment,
+        Status:     status,
+        Done:       &stats.Downloaded,
+        Cached:     &stats.Cached,
+        Lost:       &stats.Lost,
+        Requeued:   &stats.Requeued,
+        Total:      &stats.Total,
+        Live:       &stats.Live,
+        ETASeconds: &eta,
+        Rate:       &stats.Rate,
+    })
+}
+
+func (p *jsonProgress) event(id string, e archive.Event, status archive.Status) {
+    stats := func(which archive.Track) download.ProgressStats {
+        if which == archive.TrackAudio {
+            return status.Audio
+        }
+        return status.Video
+    }
+
+    switch e := e.(type) {
+    case archive.SegmentDone:
+        s := "done"
+        if e.Cached {
+            s = "cached"
+        }
+        p.segment(id, e.Track, e.Segment, s, stats(e.Track))
+    case archive.SegmentRequeued:
+        p.segment(id, e.Track, e.Segment, "requeued", stats(e.Track))
+    case archive.SegmentLost:
+        p.segment(id, e.Track, e.Segment, "lost", stats(e.Track))
+    case archive.MergeProgress:
+        p.write(&jsonEvent {
+            VideoID:  id,
+            Event:    "merge",
+            Category: "merge",
+            Audio:    &e.Audio,
+            Video:    &e.Video,
+            Total:    &e.Total,
+        })
+    case archive.DownloadFinished:
+        ev := &jsonEvent {
+            VideoID:      id,
+            Event:        "download_finished",
+            Category:     string(e.Track),
+            Total:        &e.Result.TotalSegments,
+            LostSegments: e.Result.LostSegments,
+        }
+        if e.Result.Error != nil {
+            ev.Error = e.Result.Error.Error()
+        }
+        p.write(ev)
+    }
+}
+
+func (p *jsonProgress) result(id string, res *archive.Result, err error) {
+    ev := &jsonEvent {
+        VideoID: id,
+        Event:   "result",
+        Status:  "ok",
+    }
+    if res != nil && err == nil {
+        ev.Output = res.Output
+    }
+    if err == context.Canceled {
+        ev.Status = "stopped"
+    } else if err != nil {
+        ev.Status = "failed"
+    }
+    if err != nil {
+        ev.Error = err.Error()
+    }
+    p.write(ev)
+}
+
+// creates a job that also reports it's progress as JSON if enabled
+func newJob(fregData *util.FregJson, opts archive.Options) *archive.Job {
+    if progressJSON == nil {
+        return archive.NewJob(fregData, opts)
+    }
+
+    //only called while running, after job is set
+    var job *archive.Job
+    next := opts.OnEvent
+    opts.OnEvent = func(e archive.Event) {
+        progressJSON.event(fregData.Metadata.Id, e, job.Status())
+        if next != nil {
+            next(e)
+        }
+    }
+    job = archive.NewJob(fregData, opts)
+    return job
+}
+
+// runs a job created with newJob, reporting the result as JSON if enabled
+func runJob(ctx context.Context, fregData *util.FregJson, job *archive.Job) (*archive.Result, error) {
+    res, err := job.Run(ctx)
+    if progressJSON != nil {
+        progressJSON.result(fregData.Metadata.Id, res, err)
+    }
+    return res, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+const inputWatchInterval = 10 * time.Second
+
+// re-reads the input file and swaps the URLs of the running job, so
+// downloads can continue after the original URLs expire
+func reloadInput(job *archive.Job, input string) error {
+    data, err := ioutil.ReadFile(input)
+    if err != nil {
+        return fmt.Errorf("Unable to read file '%s': %v", input, err)
+    }
+
+    var newData util.FregJson
+    if err = json.Unmarshal(data, &newData); err != nil {
+        return fmt.Errorf("Unable to parse freg json: %v", err)
+    }
+    return job.UpdateURLs(&newData)
+}
+
+// reloads the input file on SIGHUP or, if enabled, whenever it's modified,
+// until ctx is done
+func watchInput(ctx context.Context, job *archive.Job, input string) {
+    reload := make(chan os.Signal, 1)
+    notifyReload(reload)
+    defer signal.Stop(reload)
+
+    var lastModified time.Time
+    if info, err := os.Stat(input); err == nil {
+        lastModified = info.ModTime()
+    }
+
+    var tick <-chan time.Time
+    if watchInputFile {
+        ticker := time.NewTicker(inputWatchInterval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-reload:
+            log.Infof("Reload requested, reading %s", input)
+        case <-tick:
+            info, err := os.Stat(input)
+            if err != nil || !info.ModTime().After(lastModified) {
+                continue
+            }
+            lastModified = info.ModTime()
+            log.Infof("Input file changed, reloading %s", input)
+        }
+        if err := reloadInput(job, input); err != nil {
+            log.Warnf("Unable to reload input: %v", err)
+        }
+    }
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+func notifyReload(c chan<- os.Signal) {
+    signal.Notify(c, syscall.SIGHUP)
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+    "os"
+)
+
+func notifyReload(c chan<- os.Signal) {
+    // no SIGHUP, only --watch-input works
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/archive"
+    "github.com/HoloArchivists/ytarchive-raw-go/download"
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/util"
+)
+
+// big enough for inputs with an embedded thumbnail
+const maxSubmitSize = 32 * 1024 * 1024
+
+const (
+    jobQueued    = "queued"
+    jobRunning   = "running"
+    jobDone      = "done"
+    jobFailed    = "failed"
+    jobCancelled = "cancelled"
+)
+
+type serveJob struct {
+    id       string
+    ctx      context.Context
+    cancel   context.CancelFunc
+    created  time.Time
+    fregData *util.FregJson
+    job      *archive.Job
+
+    // protected by the server lock
+    state    string
+    lost     map[archive.Track][]int
+    result   *archive.Result
+    err      error
+}
+
+type server struct {
+    mu      sync.Mutex
+    cond    *sync.Cond
+    ctx     context.Context
+    client  *util.HttpClient
+    jobs    map[string]*serveJob
+    lastID  int
+    order   []string
+    pending []*serveJob
+    workers sync.WaitGroup
+}
+
+type trackJSON struct {
+    // -1 until the segment count is known
+    Total        int   `json:"total"`
+    Downloaded   int   `json:"downloaded"`
+    Cached       int   `json:"cached"`
+    Requeued     int   `json:"requeued"`
+    Lost         int   `json:"lost"`
+    LostSegments []int `json:"lost_segments"`
+    Live         bool  `json:"live"`
+}
+
+type mergeJSON struct {
+    Audio int `json:"audio"`
+    Video int `json:"video"`
+    // segments per track
+    Total int `json:"total"`
+}
+
+type jobJSON struct {
+    ID      string     `json:"id"`
+    VideoID string     `json:"video_id"`
+    Title   string     `json:"title"`
+    State   string     `json:"state"`
+    Created time.Time  `json:"created"`
+    Audio   *trackJSON `json:"audio,omitempty"`
+    Video   *trackJSON `json:"video,omitempty"`
+    Merge   mergeJSON  `json:"merge"`
+    Output  string     `json:"output,omitempty"`
+    Error   string     `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, v ...interface{}) {
+    writeJSON(w, code, map[string]string {
+        "error": fmt.Sprintf(format, v...),
+    })
+}
+
+// runs the HTTP API until ctx is cancelled, then stops the running jobs
+func runServer(ctx context.Context, client *util.HttpClient) error {
+    log.DisableProgress()
+
+    s := &server {
+        ctx:    ctx,
+        client: client,
+        jobs:   make(map[string]*serveJob),
+    }
+    s.cond = sync.NewCond(&s.mu)
+
+    for i := uint(0); i < parallel; i++ {
+        s.workers.Add(1)
+        go s.worker()
+    }
+
+    httpServer := &http.Server {
+        Addr:    listenAddress,
+        Handler: s,
+    }
+    errs := make(chan error, 1)
+    go func() {
+        errs <- httpServer.ListenAndServe()
+    }()
+    log.Infof("Listening on %s, running up to %d jobs at once", listenAddress, parallel)
+
+    select {
+    case err := <-errs:
+        return fmt.Errorf("Unable to serve API: %v", err)
+    case <-ctx.Done():
+    }
+
+    log.Info("Stopping, waiting for running jobs to stop")
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    httpServer.Shutdown(shutdownCtx)
+
+    s.mu.Lock()
+    s.cond.Broadcast()
+    queued := len(s.pending)
+    s.mu.Unlock()
+    s.workers.Wait()
+
+    if queued > 0 {
+        log.Warnf("%d queued jobs were not started", queued)
+    }
+    if tempDir != "" {
+        log.Warn("Stopped jobs can be resumed by submitting them again")
+    }
+    return nil
+}
+
+func (s *server) worker() {
+    defer s.workers.Done()
+    for {
+        s.mu.Lock()
+        for len(s.pending) == 0 && s.ctx.Err() == nil {
+            s.cond.Wait()
+        }
+        if s.ctx.Err() != nil {
+            s.mu.Unlock()
+            return
+        }
+        j := s.pending[0]
+        s.pending = s.pending[1:]
+        j.state = jobRunning
+        s.mu.Unlock()
+
+        res, err := runJob(j.ctx, j.fregData, j.job)
+        j.cancel()
+
+        s.mu.Lock()
+        j.result = res
+        j.err = err
+        switch {
+        case err == nil:
+            j.state = jobDone
+        case err == context.Canceled:
+            j.state = jobCancelled
+        default:
+            j.state = jobFailed
+        }
+        s.mu.Unlock()
+
+        logger := log.New(j.fregData.Metadata.Id)
+        if err != nil {
+            logger.Errorf("Job %s %s: %v", j.id, j.state, err)
+        } else {
+            logger.Infof("Job %s done, saved to %s", j.id, res.Output)
+        }
+    }
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+    if parts[0] != "jobs" || len(parts) > 3 {
+        writeError(w, http.StatusNotFound, "Not found")
+        return
+    }
+
+    switch {
+    case len(parts) == 1 && r.Method == http.MethodPost:
+        s.submit(w, r)
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        s.list(w)
+    case len(parts) == 2 && r.Method == http.MethodGet:
+        s.status(w, parts[1])
+    case len(parts) == 2 && r.Method == http.MethodDelete:
+        s.remove(w, parts[1])
+    case len(parts) == 3 && parts[2] == "output" && r.Method == http.MethodGet:
+        s.output(w, parts[1])
+    case len(parts) == 3 && parts[2] != "output":
+        writeError(w, http.StatusNotFound, "Not found")
+    default:
+        writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+    }
+}
+
+func (s *server) submit(w http.ResponseWriter, r *http.Request) {
+    data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSubmitSize))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Unable to read request: %v", err)
+        return
+    }
+
+    var fregData util.FregJson
+    if err = json.Unmarshal(data, &fregData); err != nil {
+        writeError(w, http.StatusBadRequest, "Unable to parse freg json: %v", err)
+        return
+    }
+    id := fregData.Metadata.Id
+    if id == "" {
+        writeError(w, http.StatusBadRequest, "Input has no video id")
+        return
+    }
+    if _, err = fregData.FormatTemplate(output, true); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid output template: %v", err)
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.ctx.Err() != nil {
+        writeError(w, http.StatusServiceUnavailable, "Shutting down")
+        return
+    }
+    //would fight over the same lock and temporary files
+    for _, other := range s.jobs {
+        if other.fregData.Metadata.Id == id && (other.state == jobQueued || other.state == jobRunning) {
+            writeError(w, http.StatusConflict, "Video %s is already being downloaded by job %s", id, other.id)
+            return
+        }
+    }
+
+    s.lastID++
+    j := &serveJob {
+        id:       strconv.Itoa(s.lastID),
+        created:  time.Now(),
+        fregData: &fregData,
+        lost:     make(map[archive.Track][]int),
+        state:    jobQueued,
+    }
+    j.ctx, j.cancel = context.WithCancel(s.ctx)
+
+    dir := tempDir
+    if dir != "" {
+        dir = filepath.Join(tempDir, id)
+    }
+    opts := jobOptions(s.client, dir)
+    opts.Logger = log.New(id)
+    opts.OnEvent = func(e archive.Event) {
+        if lost, ok := e.(archive.SegmentLost); ok {
+            s.mu.Lock()
+            j.lost[lost.Track] = append(j.lost[lost.Track], lost.Segment)
+            s.mu.Unlock()
+        }
+    }
+    j.job = newJob(&fregData, opts)
+
+    s.jobs[j.id] = j
+    s.order = append(s.order, j.id)
+    s.pending = append(s.pending, j)
+    s.cond.Signal()
+
+    opts.Logger.Infof("Queued job %s", j.id)
+    writeJSON(w, http.StatusCreated, s.describe(j))
+}
+
+func (s *server) list(w http.ResponseWriter) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    list := make([]jobJSON, 0, len(s.order))
+    for _, id := range s.order {
+        list = append(list, s.describe(s.jobs[id]))
+    }
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *server) status(w http.ResponseWriter, id string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    j, ok := s.jobs[id]
+    if !ok {
+        writeError(w, http.StatusNotFound, "No job with id %s", id)
+        return
+    }
+    writeJSON(w, http.StatusOK, s.describe(j))
+}
+
+func (s *server) output(w http.ResponseWriter, id string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    j, ok := s.jobs[id]
+    if !ok {
+        writeError(w, http.StatusNotFound, "No job with id %s", id)
+        return
+    }
+    if j.state != jobDone {
+        writeError(w, http.StatusConflict, "Job %s is %s", id, j.state)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string {
+        "output": j.result.Output,
+    })
+}
+
+// cancels active jobs, and forgets finished ones
+func (s *server) remove(w http.ResponseWriter, id string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    j, ok := s.jobs[id]
+    if !ok {
+        writeError(w, http.StatusNotFound, "No job with id %s", id)
+        return
+    }
+
+    switch j.state {
+    case jobQueued:
+        for i, other := range s.pending {
+            if other == j {
+                s.pending = append(s.pending[:i], s.pending[i + 1:]...)
+                break
+            }
+        }
+        j.cancel()
+        j.state = jobCancelled
+        j.err = context.Canceled
+        writeJSON(w, http.StatusOK, s.describe(j))
+    case jobRunning:
+        //state changes once the job has stopped
+        j.cancel()
+        writeJSON(w, http.StatusAccepted, s.describe(j))
+    default:
+        delete(s.jobs, id)
+        for i, other := range s.order {
+            if other == id {
+                s.order = append(s.order[:i], s.order[i + 1:]...)
+                break
+            }
+        }
+        writeJSON(w, http.StatusOK, s.describe(j))
+    }
+}
+
+// must be called with the lock held
+func (s *server) describe(j *serveJob) jobJSON {
+    res := jobJSON {
+        ID:      j.id,
+        VideoID: j.fregData.Metadata.Id,
+        Title:   j.fregData.Metadata.Title,
+        State:   j.state,
+        Created: j.created,
+    }
+
+    status := j.job.Status()
+    res.Merge = mergeJSON {
+        Audio: status.Merge.Audio,
+        Video: status.Merge.Video,
+        Total: status.Merge.Total,
+    }
+    track := func(stats download.ProgressStats, which archive.Track) *trackJSON {
+        lost := j.lost[which]
+        if lost == nil {
+            lost = []int {}
+        }
+        return &trackJSON {
+            Total:        stats.Total,
+            Downloaded:   stats.Downloaded,
+            Cached:       stats.Cached,
+            Requeued:     stats.Requeued,
+            Lost:         stats.Lost,
+            LostSegments: lost,
+            Live:         stats.Live,
+        }
+    }
+    if !onlyVideo {
+        res.Audio = track(status.Audio, archive.TrackAudio)
+    }
+    if !onlyAudio {
+        res.Video = track(status.Video, archive.TrackVideo)
+    }
+
+    if j.result != nil && j.err == nil {
+        res.Output = j.result.Output
+    }
+    if j.err != nil {
+        res.Error = j.err.Error()
+    }
+    return res
+}
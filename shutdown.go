@@ -0,0 +1,30 @@
+package main
+
+import (
+    "context"
+    "os"
+    "os/signal"
+    "syscall"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+)
+
+// returns a context that's cancelled on the first SIGINT or SIGTERM, so
+// downloads and muxing stop cleanly. a second signal exits immediately.
+func shutdownContext() context.Context {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    c := make(chan os.Signal, 2)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        sig := <-c
+        log.Warnf("Got %v, stopping. Press Ctrl+C again to exit immediately", sig)
+        cancel()
+
+        <-c
+        log.Error("Exiting without cleaning up, temporary files may be incomplete")
+        os.Exit(1)
+    }()
+
+    return ctx
+}
@@ -0,0 +1,162 @@
+package util
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+)
+
+var tempBytesMetric = metrics.NewGauge(
+    "ytarchive_temp_segment_bytes",
+    "Bytes of downloaded segments on disk counted against --max-temp-size.",
+)
+
+// Keeps track of how much disk space downloaded segments take, shared between
+// the downloads writing them and the mergers deleting them. Methods can be
+// called on a nil budget, which tracks nothing.
+type DiskBudget struct {
+    limit   int64
+    mu      sync.Mutex
+    used    int64
+    files   map[string]int64
+    // closed and replaced whenever space is freed
+    changed chan struct{}
+}
+
+func NewDiskBudget(limit int64) *DiskBudget {
+    return &DiskBudget {
+        limit:   limit,
+        files:   make(map[string]int64),
+        changed: make(chan struct{}),
+    }
+}
+
+func (b *DiskBudget) Limit() int64 {
+    if b == nil {
+        return 0
+    }
+    return b.limit
+}
+
+func (b *DiskBudget) Used() int64 {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.used
+}
+
+// Whether the files take as much space as the limit or more, in which case
+// downloads should wait for some to be deleted.
+func (b *DiskBudget) Exceeded() bool {
+    if b == nil {
+        return false
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.used >= b.limit
+}
+
+// Counts a file against the budget until it's deleted with Remove.
+func (b *DiskBudget) Track(path string, size int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if old, ok := b.files[path]; ok {
+        b.used -= old
+        tempBytesMetric.Add(float64(-old))
+    }
+    b.files[path] = size
+    b.used += size
+    tempBytesMetric.Add(float64(size))
+}
+
+// Deletes a file, freeing the space it took in the budget.
+func (b *DiskBudget) Remove(path string) error {
+    err := os.Remove(path)
+    if b == nil {
+        return err
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if size, ok := b.files[path]; ok {
+        delete(b.files, path)
+        b.used -= size
+        tempBytesMetric.Add(float64(-size))
+        close(b.changed)
+        b.changed = make(chan struct{})
+    }
+    return err
+}
+
+// Renames a file, which keeps counting against the budget under the new
+// name if it was tracked.
+func (b *DiskBudget) Rename(oldpath, newpath string) error {
+    err := os.Rename(oldpath, newpath)
+    if b == nil || err != nil {
+        return err
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    size, ok := b.files[oldpath]
+    if !ok {
+        return nil
+    }
+    delete(b.files, oldpath)
+    if old, ok := b.files[newpath]; ok {
+        //the old file got replaced
+        b.used -= old
+        tempBytesMetric.Add(float64(-old))
+    }
+    b.files[newpath] = size
+    return nil
+}
+
+// Deletes a directory and everything in it, freeing the space taken by
+// the files in it.
+func (b *DiskBudget) RemoveAll(dir string) error {
+    err := os.RemoveAll(dir)
+    if b == nil {
+        return err
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    prefix := filepath.Clean(dir) + string(filepath.Separator)
+    freed := false
+    for path, size := range b.files {
+        if !strings.HasPrefix(path, prefix) {
+            continue
+        }
+        //only forget what's actually gone
+        if _, statErr := os.Lstat(path); statErr == nil {
+            continue
+        }
+        delete(b.files, path)
+        b.used -= size
+        tempBytesMetric.Add(float64(-size))
+        freed = true
+    }
+    if freed {
+        close(b.changed)
+        b.changed = make(chan struct{})
+    }
+    return err
+}
+
+// Returns a channel that gets closed the next time space is freed. Get it
+// before checking Exceeded to not miss files deleted in between. A nil
+// budget never frees space.
+func (b *DiskBudget) Changed() <-chan struct{} {
+    if b == nil {
+        return nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.changed
+}
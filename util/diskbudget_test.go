@@ -0,0 +1,148 @@
+package util
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func writeTestFile(t *testing.T, path string, size int) {
+    t.Helper()
+    if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func closed(c <-chan struct{}) bool {
+    select {
+    case <-c:
+        return true
+    default:
+        return false
+    }
+}
+
+func TestDiskBudget(t *testing.T) {
+    dir := t.TempDir()
+    a := filepath.Join(dir, "a")
+    b := filepath.Join(dir, "b")
+    writeTestFile(t, a, 60)
+    writeTestFile(t, b, 40)
+
+    budget := NewDiskBudget(100)
+    budget.Track(a, 60)
+    if budget.Exceeded() {
+        t.Errorf("Budget exceeded with %d/100 bytes", budget.Used())
+    }
+    //tracking a file again replaces its size
+    budget.Track(a, 60)
+    budget.Track(b, 40)
+    if used := budget.Used(); used != 100 || !budget.Exceeded() {
+        t.Errorf("Expected 100 bytes used and the budget exceeded, got %d (exceeded: %v)", used, budget.Exceeded())
+    }
+
+    changed := budget.Changed()
+    if err := budget.Remove(a); err != nil {
+        t.Fatalf("Unable to remove tracked file: %v", err)
+    }
+    if !closed(changed) {
+        t.Error("Changed wasn't closed after freeing space")
+    }
+    if _, err := os.Stat(a); !os.IsNotExist(err) {
+        t.Error("Removed file still exists")
+    }
+    if used := budget.Used(); used != 40 || budget.Exceeded() {
+        t.Errorf("Expected 40 bytes used, got %d (exceeded: %v)", used, budget.Exceeded())
+    }
+
+    //removing it again fails, without freeing anything twice
+    changed = budget.Changed()
+    if err := budget.Remove(a); !os.IsNotExist(err) {
+        t.Errorf("Expected a not exist error removing a file twice, got %v", err)
+    }
+    if used := budget.Used(); used != 40 || closed(changed) {
+        t.Errorf("Removing a file twice changed usage to %d (changed: %v)", used, closed(changed))
+    }
+
+    //untracked files are deleted without touching the usage
+    c := filepath.Join(dir, "c")
+    writeTestFile(t, c, 10)
+    if err := budget.Remove(c); err != nil {
+        t.Fatalf("Unable to remove untracked file: %v", err)
+    }
+    if used := budget.Used(); used != 40 || closed(changed) {
+        t.Errorf("Removing an untracked file changed usage to %d (changed: %v)", used, closed(changed))
+    }
+}
+
+func TestDiskBudgetRename(t *testing.T) {
+    dir := t.TempDir()
+    partial := filepath.Join(dir, "a.incomplete")
+    done := filepath.Join(dir, "a.done")
+    writeTestFile(t, partial, 30)
+
+    budget := NewDiskBudget(100)
+    budget.Track(partial, 30)
+    if err := budget.Rename(partial, done); err != nil {
+        t.Fatalf("Unable to rename tracked file: %v", err)
+    }
+    if used := budget.Used(); used != 30 {
+        t.Errorf("Expected 30 bytes used after renaming, got %d", used)
+    }
+    if err := budget.Remove(done); err != nil {
+        t.Fatalf("Unable to remove renamed file: %v", err)
+    }
+    if used := budget.Used(); used != 0 {
+        t.Errorf("Expected nothing used after removing the renamed file, got %d", used)
+    }
+
+    //a failed rename keeps the file tracked under the old name
+    writeTestFile(t, partial, 30)
+    budget.Track(partial, 30)
+    if err := budget.Rename(partial, filepath.Join(dir, "missing", "a.done")); err == nil {
+        t.Fatal("Rename into a missing directory succeeded")
+    }
+    if err := budget.Remove(partial); err != nil || budget.Used() != 0 {
+        t.Errorf("Expected the file to still be tracked, got %d bytes used (err: %v)", budget.Used(), err)
+    }
+}
+
+func TestDiskBudgetRemoveAll(t *testing.T) {
+    dir := t.TempDir()
+    segments := filepath.Join(dir, "segments")
+    if err := os.Mkdir(segments, 0755); err != nil {
+        t.Fatal(err)
+    }
+    inside := filepath.Join(segments, "a")
+    outside := filepath.Join(dir, "segments-other")
+    writeTestFile(t, inside, 10)
+    writeTestFile(t, outside, 20)
+
+    budget := NewDiskBudget(100)
+    budget.Track(inside, 10)
+    budget.Track(outside, 20)
+    changed := budget.Changed()
+    if err := budget.RemoveAll(segments); err != nil {
+        t.Fatalf("Unable to remove directory: %v", err)
+    }
+    if used := budget.Used(); used != 20 || !closed(changed) {
+        t.Errorf("Expected 20 bytes used after removing the directory, got %d (changed: %v)", used, closed(changed))
+    }
+    if _, err := os.Stat(segments); !os.IsNotExist(err) {
+        t.Error("Removed directory still exists")
+    }
+}
+
+func TestNilDiskBudget(t *testing.T) {
+    var budget *DiskBudget
+    path := filepath.Join(t.TempDir(), "a")
+    writeTestFile(t, path, 10)
+    budget.Track(path, 10)
+    if budget.Exceeded() || budget.Used() != 0 || budget.Changed() != nil {
+        t.Error("Nil budget tracked something")
+    }
+    if err := budget.Remove(path); err != nil {
+        t.Errorf("Nil budget didn't remove the file: %v", err)
+    }
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+)
+
+var faultsMetric = metrics.NewCounter(
+    "ytarchive_injected_faults_total",
+    "Faults injected into requests with --inject-faults, by kind.",
+    "kind",
+)
+
+// Failures to inject into requests, for testing how downloads cope with
+// them. Rates are probabilities between 0 and 1, checked for every request.
+type Faults struct {
+    // delay requests by a random duration up to Latency
+    LatencyRate  float64
+    Latency      time.Duration
+    // fail requests as if the connection was reset, without sending them
+    ResetRate    float64
+    // answer requests with one of Statuses, without sending them
+    StatusRate   float64
+    Statuses     []int
+    // cut response bodies off halfway through
+    TruncateRate float64
+}
+
+// Parses a comma separated list of faults, such as
+// "latency=0.2:2s,reset=0.05,status=0.1:403:429,truncate=0.05".
+func ParseFaults(s string) (*Faults, error) {
+    f := &Faults {}
+    for _, item := range strings.Split(s, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        name, value, ok := strings.Cut(item, "=")
+        name = strings.ToLower(name)
+        if !ok {
+            return nil, fmt.Errorf("Missing rate for fault '%s'", item)
+        }
+        parts := strings.Split(value, ":")
+        rate, err := strconv.ParseFloat(parts[0], 64)
+        if err != nil || rate < 0 || rate > 1 {
+            return nil, fmt.Errorf("Invalid rate '%s' for fault '%s', must be between 0 and 1", parts[0], name)
+        }
+        args := parts[1:]
+
+        switch name {
+        case "latency":
+            if len(args) != 1 {
+                return nil, fmt.Errorf("Fault 'latency' needs a duration, such as latency=%s:2s", parts[0])
+            }
+            if f.Latency, err = time.ParseDuration(args[0]); err != nil || f.Latency <= 0 {
+                return nil, fmt.Errorf("Invalid latency '%s'", args[0])
+            }
+            f.LatencyRate = rate
+        case "reset":
+            if len(args) > 0 {
+                return nil, fmt.Errorf("Fault 'reset' only takes a rate")
+            }
+            f.ResetRate = rate
+        case "status":
+            if len(args) == 0 {
+                return nil, fmt.Errorf("Fault 'status' needs status codes, such as status=%s:403:429", parts[0])
+            }
+            for _, a := range args {
+                code, err := strconv.Atoi(a)
+                if err != nil || code < 100 || code > 599 {
+                    return nil, fmt.Errorf("Invalid status code '%s'", a)
+                }
+                f.Statuses = append(f.Statuses, code)
+            }
+            f.StatusRate = rate
+        case "truncate":
+            if len(args) > 0 {
+                return nil, fmt.Errorf("Fault 'truncate' only takes a rate")
+            }
+            f.TruncateRate = rate
+        default:
+            return nil, fmt.Errorf("Unknown fault '%s', must be one of latency, reset, status or truncate", name)
+        }
+    }
+    return f, nil
+}
+
+// Returns a middleware injecting the faults into requests.
+func FaultInjector(f *Faults) Middleware {
+    return func(next http.RoundTripper) http.RoundTripper {
+        return &faultTransport {
+            faults: f,
+            next:   next,
+        }
+    }
+}
+
+type faultTransport struct {
+    faults *Faults
+    next   http.RoundTripper
+}
+
+func chance(rate float64) bool {
+    return rate > 0 && rand.Float64() < rate
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    f := t.faults
+    if chance(f.LatencyRate) {
+        faultsMetric.Inc("latency")
+        timer := time.NewTimer(time.Duration(rand.Int63n(int64(f.Latency)) + 1))
+        select {
+        case <-timer.C:
+        case <-req.Context().Done():
+            timer.Stop()
+            return nil, req.Context().Err()
+        }
+    }
+    if chance(f.ResetRate) {
+        faultsMetric.Inc("reset")
+        return nil, &net.OpError {
+            Op:  "read",
+            Net: "tcp",
+            Err: syscall.ECONNRESET,
+        }
+    }
+    if len(f.Statuses) > 0 && chance(f.StatusRate) {
+        faultsMetric.Inc("status")
+        code := f.Statuses[rand.Intn(len(f.Statuses))]
+        body := fmt.Sprintf("Injected status %d", code)
+        return &http.Response {
+            Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+            StatusCode:    code,
+            Proto:         "HTTP/1.1",
+            ProtoMajor:    1,
+            ProtoMinor:    1,
+            Header:        make(http.Header),
+            Body:          ioutil.NopCloser(strings.NewReader(body)),
+            ContentLength: int64(len(body)),
+            Request:       req,
+        }, nil
+    }
+
+    resp, err := t.next.RoundTrip(req)
+    if err == nil && chance(f.TruncateRate) {
+        faultsMetric.Inc("truncate")
+        limit := resp.ContentLength / 2
+        if limit < 0 {
+            limit = 0
+        }
+        resp.Body = &truncatedBody {
+            body: resp.Body,
+            left: limit,
+        }
+    }
+    return resp, err
+}
+
+// fails with io.ErrUnexpectedEOF once left bytes were read, like a dropped
+// connection would
+type truncatedBody struct {
+    body io.ReadCloser
+    left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+    if b.left <= 0 {
+        return 0, io.ErrUnexpectedEOF
+    }
+    if int64(len(p)) > b.left {
+        p = p[:b.left]
+    }
+    n, err := b.body.Read(p)
+    b.left -= int64(n)
+    return n, err
+}
+
+func (b *truncatedBody) Close() error {
+    return b.body.Close()
+}
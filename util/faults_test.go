@@ -0,0 +1,48 @@
+package util
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseFaults(t *testing.T) {
+    f, err := ParseFaults("latency=0.2:2s, reset=0.05,STATUS=0.1:403:429,truncate=1,")
+    if err != nil {
+        t.Fatalf("Valid faults failed to parse: %v", err)
+    }
+    if f.LatencyRate != 0.2 || f.Latency != 2 * time.Second {
+        t.Errorf("Expected latency 0.2 up to 2s, got %v up to %v", f.LatencyRate, f.Latency)
+    }
+    if f.ResetRate != 0.05 || f.TruncateRate != 1 {
+        t.Errorf("Expected reset 0.05 and truncate 1, got %v and %v", f.ResetRate, f.TruncateRate)
+    }
+    if f.StatusRate != 0.1 || len(f.Statuses) != 2 || f.Statuses[0] != 403 || f.Statuses[1] != 429 {
+        t.Errorf("Expected status 0.1 with 403 and 429, got %v with %v", f.StatusRate, f.Statuses)
+    }
+
+    f, err = ParseFaults("")
+    if err != nil || f.LatencyRate != 0 || f.ResetRate != 0 || f.StatusRate != 0 || f.TruncateRate != 0 {
+        t.Errorf("Expected no faults from an empty string, got %+v (err: %v)", f, err)
+    }
+
+    invalid := []string {
+        "reset",
+        "reset=2",
+        "reset=-0.1",
+        "reset=abc",
+        "reset=0.1:5",
+        "latency=0.1",
+        "latency=0.1:abc",
+        "latency=0.1:-1s",
+        "status=0.1",
+        "status=0.1:42",
+        "status=0.1:abc",
+        "truncate=0.1:5",
+        "explode=0.1",
+    }
+    for _, s := range invalid {
+        if _, err := ParseFaults(s); err == nil {
+            t.Errorf("Invalid faults '%s' were accepted", s)
+        }
+    }
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+    "strings"
+    "syscall"
+)
+
+const FreebindSupported = true
+
+// not in the syscall package
+const ipv6Freebind = 78
+
+func freebindControl(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        if strings.HasSuffix(network, "6") {
+            sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Freebind, 1)
+            if sockErr == nil {
+                return
+            }
+            //kernels before 4.15 only have the ipv4 option, which also
+            //works for ipv6 sockets
+        }
+        sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import (
+    "fmt"
+    "syscall"
+)
+
+const FreebindSupported = false
+
+func freebindControl(network, address string, c syscall.RawConn) error {
+    return fmt.Errorf("Freebind is not supported on this platform")
+}
@@ -1,16 +1,15 @@
 package util
 
 import (
-    "bufio"
     "context"
     "crypto/tls"
+    "errors"
     "fmt"
     "io"
-    "math/rand"
-    "os"
     "net"
     "net/http"
-    "strings"
+    "net/url"
+    "strconv"
     "sync"
     "time"
 
@@ -18,6 +17,9 @@ import (
     "github.com/lucas-clemente/quic-go/http3"
 
     "inet.af/netaddr"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
 )
 
 type Network int
@@ -29,6 +31,17 @@ const (
 
 var closeRequested = fmt.Errorf("Client close requested")
 
+// consecutive failed HTTP/3 requests before a requester falls back to TCP
+const quicFailThreshold = 3
+// how long a requester stays on TCP before trying HTTP/3 again
+const quicRetryInterval = 5 * time.Minute
+
+var requestsMetric = metrics.NewCounter(
+    "ytarchive_ip_requests_total",
+    "HTTP requests by local address, and status code or 'error' if the request failed.",
+    "ip", "code",
+)
+
 func netaddr2net(ip netaddr.IP) net.IP {
     if ip.Is6() {
         ip6 := ip.As16()
@@ -39,47 +52,20 @@ func netaddr2net(ip netaddr.IP) net.IP {
     }
 }
 
-type IPPool struct {
-    Addresses []netaddr.IP
-}
-
-func ParseIPPool(path string) (*IPPool, error) {
-    file, err := os.Open(path)
-    if err != nil {
-        return nil, err
-    }
-    defer file.Close()
-
-    pool := &IPPool {}
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := strings.TrimSpace(scanner.Text())
-        if line == "" {
-            continue
-        }
-        ip, err := netaddr.ParseIP(line)
-        if err != nil {
-            return nil, err
-        }
-        pool.Addresses = append(pool.Addresses, ip)
-    }
-    if err = scanner.Err(); err != nil {
-        return nil, err
-    }
-    return pool, nil
-}
-
-func (p *IPPool) random() netaddr.IP {
-    if len(p.Addresses) == 0 {
-        panic("No IP addresses in pool")
-    }
-    return p.Addresses[rand.Intn(len(p.Addresses))]
-}
+// Wraps the transport requests are sent with, for example to inject faults
+// or inspect requests
+type Middleware func(http.RoundTripper) http.RoundTripper
 
 type HttpClientConfig struct {
-    IPPool  *IPPool
-    Network Network
-    UseQuic bool
+    // allows binding to addresses not assigned to any interface, needed to
+    // use routed ranges of the IP pool. only supported on linux.
+    Freebind   bool
+    IPPool     *IPPool
+    // applied in order to the transport of every client, so the last one
+    // sees requests first
+    Middleware []Middleware
+    Network    Network
+    UseQuic    bool
 }
 
 type HttpClient struct {
@@ -87,9 +73,13 @@ type HttpClient struct {
     socketsLock    sync.Mutex
     sockets        map[netaddr.IP]quic.OOBCapablePacketConn
     requestersLock sync.Mutex
-    requesters     map[netaddr.IP]*HttpRequester
-    // used for NetworkAny
-    anyRequester   *HttpRequester
+    requesters     map[requesterKey]*HttpRequester
+}
+
+type requesterKey struct {
+    // zero for any address
+    ip    netaddr.IP
+    proxy *url.URL
 }
 
 func NewClient(cfg *HttpClientConfig) *HttpClient {
@@ -98,49 +88,71 @@ func NewClient(cfg *HttpClientConfig) *HttpClient {
     }
 }
 
+// address to bind to when the IP pool doesn't set one, nil for any
+func (c *HttpClient) defaultBindAddr() *netaddr.IP {
+    switch c.cfg.Network {
+    case NetworkAny:
+        return nil
+    case NetworkIPv4:
+        a := netaddr.IPv4(0, 0, 0, 0)
+        return &a
+    case NetworkIPv6:
+        a := netaddr.IPv6Unspecified()
+        return &a
+    default:
+        panic(fmt.Sprintf("Unhandled network type %v", c.cfg.Network))
+    }
+}
+
 func (c *HttpClient) GetRequester() *HttpRequester {
     var bindAddr *netaddr.IP
+    var entry *IPPoolEntry
     if c.cfg.IPPool != nil {
-        a := c.cfg.IPPool.random()
-        bindAddr = &a
-    } else {
-        switch c.cfg.Network {
-        case NetworkAny:
-            bindAddr = nil
-        case NetworkIPv4:
-            a := netaddr.IPv4(0, 0, 0, 0)
-            bindAddr = &a
-        case NetworkIPv6:
-            a := netaddr.IPv6Unspecified()
+        a, e := c.cfg.IPPool.random()
+        entry = &e
+        if !a.IsZero() {
             bindAddr = &a
-        default:
-            panic(fmt.Sprintf("Unhandled network type %v", c.cfg.Network))
+        } else {
+            bindAddr = c.defaultBindAddr()
         }
-    }
-    c.requestersLock.Lock()
-    defer c.requestersLock.Unlock()
 
-    if bindAddr == nil {
-        if c.anyRequester == nil {
-            c.anyRequester = &HttpRequester {
-                owner: c,
-                ip:    nil,
+        //random addresses from a range are unlikely to be picked again, so
+        //they aren't shared and get cleaned up by Release
+        if !e.Prefix.IsZero() && !e.Prefix.IsSingleIP() {
+            return &HttpRequester {
+                owner:     c,
+                ip:        bindAddr,
+                entry:     entry,
+                ephemeral: true,
             }
         }
-        return c.anyRequester
+    } else {
+        bindAddr = c.defaultBindAddr()
     }
 
+    key := requesterKey {}
+    if bindAddr != nil {
+        key.ip = *bindAddr
+    }
+    if entry != nil {
+        key.proxy = entry.Proxy
+    }
+
+    c.requestersLock.Lock()
+    defer c.requestersLock.Unlock()
+
     if c.requesters == nil {
-        c.requesters = make(map[netaddr.IP]*HttpRequester)
+        c.requesters = make(map[requesterKey]*HttpRequester)
     }
 
-    req := c.requesters[*bindAddr]
+    req := c.requesters[key]
     if req == nil {
         req = &HttpRequester {
             owner: c,
             ip:    bindAddr,
+            entry: entry,
         }
-        c.requesters[*bindAddr] = req
+        c.requesters[key] = req
     }
     return req
 }
@@ -155,25 +167,42 @@ func (c *HttpClient) getSocket(ip netaddr.IP) (quic.OOBCapablePacketConn, error)
         return conn, nil
     }
 
+    udpConn, err := c.listenUDP(ip)
+    if err != nil {
+        return nil, err
+    }
+    c.sockets[ip] = udpConn
+    return udpConn, nil
+}
+
+func (c *HttpClient) listenUDP(ip netaddr.IP) (*net.UDPConn, error) {
     var network string
     if ip.Is6() {
         network = "udp6"
     } else {
         network = "udp4"
     }
-    addr := netaddr2net(ip)
+    lc := &net.ListenConfig {}
+    if c.cfg.Freebind {
+        lc.Control = freebindControl
+    }
 
-    udpConn, err := net.ListenUDP(network, &net.UDPAddr{IP: addr, Port: 0})
+    conn, err := lc.ListenPacket(context.Background(), network, net.JoinHostPort(ip.String(), "0"))
     if err != nil {
         return nil, err
     }
-    c.sockets[ip] = udpConn
-    return udpConn, nil
+    return conn.(*net.UDPConn), nil
 }
 
-func (c *HttpClient) createClient(ip *netaddr.IP) *internalClient {
+// ephemeral clients get their own sockets, closed with the client
+func (c *HttpClient) createClient(r *HttpRequester, useQuic bool) *internalClient {
+    ip := r.ip
+    ephemeral := r.ephemeral
+    ic := &internalClient {
+        quic: useQuic,
+    }
     var rt http.RoundTripper
-    if c.cfg.UseQuic {
+    if useQuic {
         t := &http3.RoundTripper {}
         if ip != nil {
             t.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
@@ -188,9 +217,19 @@ func (c *HttpClient) createClient(ip *netaddr.IP) *internalClient {
                 if err != nil {
                     return nil, err
                 }
-                udpConn, err := c.getSocket(*ip)
-                if err != nil {
-                    return nil, err
+                var udpConn quic.OOBCapablePacketConn
+                if ephemeral {
+                    conn, err := c.listenUDP(*ip)
+                    if err != nil {
+                        return nil, err
+                    }
+                    ic.addSocket(conn)
+                    udpConn = conn
+                } else {
+                    udpConn, err = c.getSocket(*ip)
+                    if err != nil {
+                        return nil, err
+                    }
                 }
                 return quic.DialEarly(udpConn, remoteAddr, addr, tlsCfg, cfg)
             }
@@ -204,22 +243,39 @@ func (c *HttpClient) createClient(ip *netaddr.IP) *internalClient {
                 KeepAlive: 30 * time.Second,
                 LocalAddr: &net.TCPAddr{IP: netaddr2net(*ip), Port: 0},
             }
+            if c.cfg.Freebind {
+                dialer.Control = freebindControl
+            }
             t.DialContext = dialer.DialContext
         }
+        if proxy := r.proxy(); proxy != nil {
+            t.Proxy = http.ProxyURL(proxy)
+        }
         rt = t
     }
-    return &internalClient {
-        client: &http.Client {
-            Transport: rt,
-        },
+    ic.transport = rt
+    for _, m := range c.cfg.Middleware {
+        rt = m(rt)
+    }
+    ic.client = &http.Client {
+        Transport: rt,
     }
+    return ic
 }
 
 type HttpRequester struct {
-    owner  *HttpClient
-    client *internalClient
-    ip     *netaddr.IP
-    mu     sync.Mutex
+    owner     *HttpClient
+    client    *internalClient
+    ip        *netaddr.IP
+    // entry of the IP pool the address came from, nil without a pool
+    entry     *IPPoolEntry
+    // not shared with other users of the client
+    ephemeral bool
+    mu        sync.Mutex
+    // consecutive failed HTTP/3 requests
+    quicFails int
+    // HTTP/3 isn't used until then, zero when it's working
+    tcpUntil  time.Time
 }
 
 func (r *HttpRequester) Dispose() {
@@ -232,15 +288,123 @@ func (r *HttpRequester) Dispose() {
     }
 }
 
+// called when the requester isn't needed anymore. shared requesters are kept
+// for other users.
+func (r *HttpRequester) Release() {
+    if r.ephemeral {
+        r.Dispose()
+    }
+}
+
+func (r *HttpRequester) proxy() *url.URL {
+    if r.entry != nil {
+        return r.entry.Proxy
+    }
+    return nil
+}
+
+// address used for logs and metrics. ranges get a single name, instead of
+// one per random address.
+func (r *HttpRequester) name() string {
+    if r.entry != nil {
+        return r.entry.String()
+    } else if r.ip != nil {
+        return r.ip.String()
+    }
+    return "default"
+}
+
 func (r *HttpRequester) Do(req *http.Request) (*http.Response, error) {
     r.mu.Lock()
+    //neither CONNECT nor socks5 proxies can carry HTTP/3
+    useQuic := r.owner.cfg.UseQuic && r.proxy() == nil
+    if useQuic && !r.tcpUntil.IsZero() {
+        if time.Now().Before(r.tcpUntil) {
+            useQuic = false
+        } else {
+            log.Infof("Trying HTTP/3 again for %s", r.name())
+            r.tcpUntil = time.Time{}
+            if r.client != nil {
+                r.client.startClose()
+                r.client = nil
+            }
+        }
+    }
     if r.client == nil {
-        r.client = r.owner.createClient(r.ip)
+        r.client = r.owner.createClient(r, useQuic)
     }
     c := r.client
     r.mu.Unlock()
 
-    return c.do(req)
+    resp, err := c.do(req)
+
+    code := "error"
+    if err == nil {
+        code = strconv.Itoa(resp.StatusCode)
+    }
+    requestsMetric.Inc(r.name(), code)
+
+    //cancelled requests and closed clients say nothing about the address or
+    //transport
+    if err == closeRequested || req.Context().Err() != nil {
+        return resp, err
+    }
+    if pool := r.owner.cfg.IPPool; pool != nil && r.entry != nil {
+        pool.record(*r.entry, isIPFailure(resp, err))
+    }
+    if c.quic {
+        r.quicResult(c, err)
+    }
+
+    return resp, err
+}
+
+// whether a request failed because of the QUIC connection itself, such as
+// handshakes or idle timeouts when UDP is blocked, rather than the server or
+// something in between
+func isQuicFailure(err error) bool {
+    var idle *quic.IdleTimeoutError
+    var handshake *quic.HandshakeTimeoutError
+    var transport *quic.TransportError
+    return errors.As(err, &idle) || errors.As(err, &handshake) || errors.As(err, &transport)
+}
+
+// switches to TCP if HTTP/3 connections keep failing, for example when UDP
+// is blocked for the address
+func (r *HttpRequester) quicResult(c *internalClient, err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    //already replaced
+    if r.client != c {
+        return
+    }
+    if err == nil {
+        r.quicFails = 0
+        return
+    }
+    //other errors say nothing about whether HTTP/3 works
+    if !isQuicFailure(err) {
+        return
+    }
+    r.quicFails++
+    if r.quicFails < quicFailThreshold {
+        return
+    }
+
+    log.Warnf("HTTP/3 requests from %s keep failing (%v), using TCP for the next %v", r.name(), err, quicRetryInterval)
+    r.quicFails = 0
+    r.tcpUntil = time.Now().Add(quicRetryInterval)
+    r.client.startClose()
+    r.client = nil
+}
+
+// whether the address used by this requester is not quarantined
+func (r *HttpRequester) Healthy() bool {
+    if pool := r.owner.cfg.IPPool; pool != nil && r.entry != nil {
+        return !pool.Quarantined(*r.entry)
+    }
+    return true
 }
 
 func (r *HttpRequester) Get(url string) (*http.Response, error) {
@@ -255,15 +419,32 @@ func (r *HttpRequester) Get(url string) (*http.Response, error) {
 // so instead closing here only requests that it gets closed later
 type internalClient struct {
     client          *http.Client
+    // without middleware, closed with the client
+    transport       http.RoundTripper
     mu              sync.Mutex
     shouldClose     bool
     pendingRequests int
+    // owned by this client, closed with it
+    sockets         []net.PacketConn
+    // uses HTTP/3 instead of TCP
+    quic            bool
+}
+
+func (c *internalClient) addSocket(conn net.PacketConn) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.sockets = append(c.sockets, conn)
 }
 
+//must be called with the lock held
 func (c *internalClient) doClose() {
-    if cl, ok := c.client.Transport.(io.Closer); ok {
+    if cl, ok := c.transport.(io.Closer); ok {
         cl.Close()
     }
+    for _, conn := range c.sockets {
+        conn.Close()
+    }
+    c.sockets = nil
 }
 
 func (c *internalClient) startClose() {
@@ -0,0 +1,35 @@
+package util
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "syscall"
+    "testing"
+
+    "github.com/lucas-clemente/quic-go"
+)
+
+func TestIsQuicFailure(t *testing.T) {
+    wrap := func(err error) error {
+        return &url.Error { Op: "Get", URL: "https://example.com", Err: err }
+    }
+    tests := []struct {
+        err      error
+        expected bool
+    } {
+        { err: &quic.IdleTimeoutError {}, expected: true },
+        { err: wrap(&quic.HandshakeTimeoutError {}), expected: true },
+        { err: wrap(fmt.Errorf("dial: %w", &quic.TransportError {})), expected: true },
+        //injected by FaultInjector
+        { err: wrap(&net.OpError { Op: "read", Net: "tcp", Err: syscall.ECONNRESET }), expected: false },
+        { err: wrap(io.ErrUnexpectedEOF), expected: false },
+        { err: fmt.Errorf("Server failed"), expected: false },
+    }
+    for _, test := range tests {
+        if got := isQuicFailure(test.err); got != test.expected {
+            t.Errorf("isQuicFailure(%v) = %v, expected %v", test.err, got, test.expected)
+        }
+    }
+}
@@ -0,0 +1,444 @@
+package util
+
+import (
+    "bufio"
+    "fmt"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "inet.af/netaddr"
+
+    "github.com/HoloArchivists/ytarchive-raw-go/log"
+    "github.com/HoloArchivists/ytarchive-raw-go/metrics"
+)
+
+const DefaultIPErrorThreshold = 0.5
+const DefaultIPCooldown = time.Minute
+
+// quarantines get longer for addresses that keep failing, up to this
+const maxIPCooldown = 30 * time.Minute
+// requests needed before an address can be quarantined
+const ipMinSamples = 10
+// weight of each request in the error rate, higher forgets older requests
+// faster
+const ipErrorDecay = 0.1
+
+var quarantinedMetric = metrics.NewGauge(
+    "ytarchive_ip_quarantined",
+    "Whether an entry of the IP pool is quarantined for failing too often.",
+    "ip",
+)
+
+type ipStats struct {
+    requests    uint64
+    failures    uint64
+    // moving average of failures, between 0 and 1
+    errorRate   float64
+    // requests since the address was added or left quarantine
+    samples     int
+    quarantines int
+    until       time.Time
+}
+
+// Where requests come from: an address or range to bind to, a proxy, or both.
+type IPPoolEntry struct {
+    // single address, or range to pick random addresses from such as a
+    // routed ipv6 prefix. zero to use the default address.
+    Prefix netaddr.IPPrefix
+    // proxy to connect through, nil to connect directly
+    Proxy  *url.URL
+}
+
+type IPPool struct {
+    // health is tracked per entry, so for ranges it's tracked for the
+    // whole range
+    Entries        []IPPoolEntry
+    // error rate (0 to 1) at which entries get quarantined
+    ErrorThreshold float64
+    // how long the first quarantine of an address lasts, doubling every
+    // time it gets quarantined again
+    Cooldown       time.Duration
+    mu             sync.Mutex
+    stats          map[IPPoolEntry]*ipStats
+}
+
+// Requests made through an entry of the pool, for the summary at the end.
+type IPHealth struct {
+    // see IPPoolEntry.String
+    Source      string
+    Requests    uint64
+    Failures    uint64
+    ErrorRate   float64
+    Quarantines int
+    Quarantined bool
+}
+
+// Each line of the file can be empty, or contain an IP address, a range in
+// CIDR notation or the name of a network interface, whose addresses are used.
+// Lines can also set a proxy with `proxy=URL` after the address, or on it's
+// own to use the default address.
+func ParseIPPool(path string) (*IPPool, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    pool := &IPPool {}
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if err = pool.add(line); err != nil {
+            return nil, err
+        }
+    }
+    if err = scanner.Err(); err != nil {
+        return nil, err
+    }
+    if len(pool.Entries) == 0 {
+        return nil, fmt.Errorf("No addresses in %s", path)
+    }
+    return pool, nil
+}
+
+// Creates a pool that uses the default address through each of the proxies.
+func NewProxyPool(proxies []*url.URL) *IPPool {
+    pool := &IPPool {}
+    for _, proxy := range proxies {
+        pool.Entries = append(pool.Entries, IPPoolEntry { Proxy: proxy })
+    }
+    return pool
+}
+
+// Makes entries without a proxy use the given ones. with more than one
+// proxy, each of those entries is replaced by one per proxy.
+func (p *IPPool) SetDefaultProxies(proxies []*url.URL) {
+    if len(proxies) == 0 {
+        return
+    }
+    var entries []IPPoolEntry
+    for _, e := range p.Entries {
+        if e.Proxy != nil {
+            entries = append(entries, e)
+            continue
+        }
+        for _, proxy := range proxies {
+            entries = append(entries, IPPoolEntry { Prefix: e.Prefix, Proxy: proxy })
+        }
+    }
+    p.Entries = entries
+}
+
+// whether some entries are ranges, which usually need freebind
+func (p *IPPool) HasRanges() bool {
+    for _, e := range p.Entries {
+        if !e.Prefix.IsZero() && !e.Prefix.IsSingleIP() {
+            return true
+        }
+    }
+    return false
+}
+
+// Parses a proxy URL, with a http, https or socks5 scheme.
+func ParseProxy(s string) (*url.URL, error) {
+    u, err := url.Parse(s)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid proxy '%s': %v", s, err)
+    }
+    switch u.Scheme {
+    case "http", "https", "socks5":
+    default:
+        return nil, fmt.Errorf("Invalid proxy '%s': scheme must be http, https or socks5", s)
+    }
+    if u.Host == "" {
+        return nil, fmt.Errorf("Invalid proxy '%s': missing host", s)
+    }
+    return u, nil
+}
+
+func (p *IPPool) add(line string) error {
+    var address string
+    var proxy *url.URL
+    for _, field := range strings.Fields(line) {
+        switch {
+        case strings.HasPrefix(field, "proxy="):
+            if proxy != nil {
+                return fmt.Errorf("More than one proxy in line '%s'", line)
+            }
+            u, err := ParseProxy(strings.TrimPrefix(field, "proxy="))
+            if err != nil {
+                return err
+            }
+            proxy = u
+        case address == "":
+            address = field
+        default:
+            return fmt.Errorf("Unexpected '%s' in line '%s'", field, line)
+        }
+    }
+
+    if address == "" {
+        p.Entries = append(p.Entries, IPPoolEntry { Proxy: proxy })
+        return nil
+    }
+    return p.addAddress(address, proxy)
+}
+
+func (p *IPPool) addAddress(address string, proxy *url.URL) error {
+    add := func(prefix netaddr.IPPrefix) {
+        p.Entries = append(p.Entries, IPPoolEntry { Prefix: prefix, Proxy: proxy })
+    }
+    if ip, err := netaddr.ParseIP(address); err == nil {
+        add(netaddr.IPPrefixFrom(ip, ip.BitLen()))
+        return nil
+    }
+    if prefix, err := netaddr.ParseIPPrefix(address); err == nil {
+        add(prefix.Masked())
+        return nil
+    }
+
+    iface, err := net.InterfaceByName(address)
+    if err != nil {
+        return fmt.Errorf("'%s' is not an IP address, range or interface name", address)
+    }
+    addrs, err := iface.Addrs()
+    if err != nil {
+        return fmt.Errorf("Unable to get addresses of interface %s: %v", address, err)
+    }
+    found := false
+    for _, addr := range addrs {
+        ipNet, ok := addr.(*net.IPNet)
+        if !ok {
+            continue
+        }
+        ip, ok := netaddr.FromStdIP(ipNet.IP)
+        //link local addresses would need the zone
+        if !ok || ip.IsLinkLocalUnicast() {
+            continue
+        }
+        add(netaddr.IPPrefixFrom(ip, ip.BitLen()))
+        found = true
+    }
+    if !found {
+        return fmt.Errorf("Interface %s has no usable addresses", address)
+    }
+    return nil
+}
+
+// The address or range in CIDR notation, and the proxy without it's
+// password. Used in logs and metrics.
+func (e IPPoolEntry) String() string {
+    var name string
+    switch {
+    case e.Prefix.IsZero():
+        name = "default"
+    case e.Prefix.IsSingleIP():
+        name = e.Prefix.IP().String()
+    default:
+        name = e.Prefix.String()
+    }
+    if e.Proxy != nil {
+        name += " via " + e.Proxy.Redacted()
+    }
+    return name
+}
+
+// random address inside the range, avoiding the all zeros address and the
+// ipv4 broadcast address. zero for entries without an address.
+func randomIn(prefix netaddr.IPPrefix) netaddr.IP {
+    if prefix.IsZero() {
+        return netaddr.IP {}
+    }
+    if prefix.IsSingleIP() {
+        return prefix.IP()
+    }
+    last := prefix.Range().To()
+    for {
+        var ip netaddr.IP
+        if prefix.IP().Is4() {
+            b := prefix.IP().As4()
+            randomizeBits(b[:], int(prefix.Bits()))
+            ip = netaddr.IPFrom4(b)
+        } else {
+            b := prefix.IP().As16()
+            randomizeBits(b[:], int(prefix.Bits()))
+            ip = netaddr.IPFrom16(b)
+        }
+        if ip == prefix.IP() || (ip.Is4() && ip == last && prefix.Bits() < 31) {
+            continue
+        }
+        return ip
+    }
+}
+
+// randomizes every bit after the first `keep` ones
+func randomizeBits(b []byte, keep int) {
+    for i := range b {
+        if keep >= 8 {
+            keep -= 8
+            continue
+        }
+        mask := byte(0xff >> keep)
+        b[i] = (b[i] &^ mask) | (byte(rand.Intn(256)) & mask)
+        keep = 0
+    }
+}
+
+//must be called with the lock held
+func (p *IPPool) statsFor(entry IPPoolEntry) *ipStats {
+    if p.stats == nil {
+        p.stats = make(map[IPPoolEntry]*ipStats)
+    }
+    s, ok := p.stats[entry]
+    if !ok {
+        s = &ipStats {}
+        p.stats[entry] = s
+        quarantinedMetric.SetFunc(func() float64 {
+            if p.Quarantined(entry) {
+                return 1
+            }
+            return 0
+        }, entry.String())
+    }
+    return s
+}
+
+// picks an entry and an address from it, preferring the entries with less
+// errors. quarantined entries are only used if all of them are.
+func (p *IPPool) random() (netaddr.IP, IPPoolEntry) {
+    sources := p.Entries
+    if len(sources) == 0 {
+        panic("No entries in IP pool")
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := time.Now()
+    weights := make([]float64, len(sources))
+    total := 0.0
+    soonest := -1
+    for i, source := range sources {
+        s := p.statsFor(source)
+        if now.Before(s.until) {
+            if soonest < 0 || s.until.Before(p.stats[sources[soonest]].until) {
+                soonest = i
+            }
+            continue
+        }
+        //healthy addresses get most of the traffic, but bad ones still get
+        //some so they can recover
+        ok := 1 - s.errorRate
+        weights[i] = ok * ok + 0.05
+        total += weights[i]
+    }
+    pick := soonest
+    if total > 0 {
+        r := rand.Float64() * total
+        for i, w := range weights {
+            if w > 0 {
+                //rounding errors might leave r > 0 at the end
+                pick = i
+            }
+            r -= w
+            if w > 0 && r < 0 {
+                break
+            }
+        }
+    }
+    return randomIn(sources[pick].Prefix), sources[pick]
+}
+
+// whether a response means the address itself is having problems, rather
+// than the request being wrong
+func isIPFailure(resp *http.Response, err error) bool {
+    if err != nil {
+        return true
+    }
+    return resp.StatusCode == http.StatusForbidden ||
+        resp.StatusCode == http.StatusTooManyRequests ||
+        resp.StatusCode >= 500
+}
+
+func (p *IPPool) record(source IPPoolEntry, failed bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    s := p.statsFor(source)
+    now := time.Now()
+    //requests started before the quarantine
+    if now.Before(s.until) {
+        return
+    }
+
+    s.requests++
+    s.samples++
+    fail := 0.0
+    if failed {
+        s.failures++
+        fail = 1
+    }
+    s.errorRate = s.errorRate * (1 - ipErrorDecay) + fail * ipErrorDecay
+
+    threshold := p.ErrorThreshold
+    if threshold <= 0 {
+        threshold = DefaultIPErrorThreshold
+    }
+    if s.samples < ipMinSamples || s.errorRate < threshold {
+        return
+    }
+
+    cooldown := p.Cooldown
+    if cooldown <= 0 {
+        cooldown = DefaultIPCooldown
+    }
+    for i := 0; i < s.quarantines && cooldown < maxIPCooldown; i++ {
+        cooldown *= 2
+    }
+    if cooldown > maxIPCooldown {
+        cooldown = maxIPCooldown
+    }
+
+    s.quarantines++
+    s.until = now.Add(cooldown)
+    //start over once it's back
+    s.errorRate = 0
+    s.samples = 0
+    log.Warnf("IP %s is failing too often (%d/%d requests failed), not using it for %v", source, s.failures, s.requests, cooldown)
+}
+
+func (p *IPPool) Quarantined(source IPPoolEntry) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    s, ok := p.stats[source]
+    return ok && time.Now().Before(s.until)
+}
+
+func (p *IPPool) Health() []IPHealth {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := time.Now()
+    res := make([]IPHealth, 0, len(p.Entries))
+    for _, source := range p.Entries {
+        s := p.statsFor(source)
+        res = append(res, IPHealth {
+            Source:      source.String(),
+            Requests:    s.requests,
+            Failures:    s.failures,
+            ErrorRate:   s.errorRate,
+            Quarantines: s.quarantines,
+            Quarantined: now.Before(s.until),
+        })
+    }
+    return res
+}
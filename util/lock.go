@@ -1,26 +1,27 @@
 package util
 
 import (
+    "fmt"
     "os"
 
     "github.com/gofrs/flock"
-
-    "github.com/HoloArchivists/ytarchive-raw-go/log"
 )
 
-func LockFile(path string, printFailureMessage func()) func() {
+var ErrLocked = fmt.Errorf("File is locked by another process")
+
+// Locks path, returning a function that releases the lock. Returns ErrLocked
+// if another process holds it.
+func TryLockFile(path string) (func(), error) {
     lock := flock.New(path)
     locked, err := lock.TryLock()
     if err != nil {
-        log.Fatalf("Failed to lock file: %v", err)
+        return nil, fmt.Errorf("Failed to lock file: %v", err)
     }
     if !locked {
-        printFailureMessage()
-        os.Exit(1)
+        return nil, ErrLocked
     }
     return func() {
         lock.Unlock()
         os.Remove(path)
-    }
+    }, nil
 }
-
@@ -0,0 +1,100 @@
+package util
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// reads are split so a single one doesn't have to wait for too long
+const rateLimitChunk = 16 * 1024
+
+// Limits throughput to a number of bytes per second, shared between every
+// reader using it.
+type RateLimiter struct {
+    mu     sync.Mutex
+    rate   float64
+    // how many bytes can be read at once after being idle
+    burst  float64
+    // can go negative, readers wait until it's back to zero
+    tokens float64
+    last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+    burst := float64(bytesPerSecond)
+    if burst < rateLimitChunk {
+        burst = rateLimitChunk
+    }
+    return &RateLimiter {
+        rate:   float64(bytesPerSecond),
+        burst:  burst,
+        tokens: burst,
+        last:   time.Now(),
+    }
+}
+
+// takes n bytes from the budget, waiting until they're available
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+    l.mu.Lock()
+    now := time.Now()
+    l.tokens += now.Sub(l.last).Seconds() * l.rate
+    if l.tokens > l.burst {
+        l.tokens = l.burst
+    }
+    l.last = now
+    l.tokens -= float64(n)
+    tokens := l.tokens
+    l.mu.Unlock()
+
+    if tokens >= 0 {
+        return nil
+    }
+    timer := time.NewTimer(time.Duration(-tokens / l.rate * float64(time.Second)))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+type limitedReader struct {
+    ctx      context.Context
+    r        io.Reader
+    limiters []*RateLimiter
+}
+
+// Wraps r so reads respect every limiter. nil limiters are ignored, and r is
+// returned as is if all of them are nil. Waiting stops when ctx is cancelled.
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+    var used []*RateLimiter
+    for _, l := range limiters {
+        if l != nil {
+            used = append(used, l)
+        }
+    }
+    if len(used) == 0 {
+        return r
+    }
+    return &limitedReader {
+        ctx:      ctx,
+        r:        r,
+        limiters: used,
+    }
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+    if len(p) > rateLimitChunk {
+        p = p[:rateLimitChunk]
+    }
+    n, err := r.r.Read(p)
+    for _, l := range r.limiters {
+        if waitErr := l.wait(r.ctx, n); waitErr != nil {
+            return n, waitErr
+        }
+    }
+    return n, err
+}
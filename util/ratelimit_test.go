@@ -0,0 +1,48 @@
+package util
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestRateLimiter(t *testing.T) {
+    l := NewRateLimiter(256 * 1024)
+    start := time.Now()
+    //the first 256K are the burst, the rest takes a second
+    r := LimitReader(context.Background(), bytes.NewReader(make([]byte, 512 * 1024)), l)
+    n, err := io.Copy(ioutil.Discard, r)
+    if err != nil || n != 512 * 1024 {
+        t.Fatalf("Expected to read 512K, got %d (err: %v)", n, err)
+    }
+    if elapsed := time.Since(start); elapsed < 900 * time.Millisecond || elapsed > 3 * time.Second {
+        t.Errorf("Reading 512K at 256K/s with a 256K burst took %v, expected about 1s", elapsed)
+    }
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+    l := NewRateLimiter(1024)
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    r := LimitReader(ctx, bytes.NewReader(make([]byte, 1024 * 1024)), l)
+    if _, err := io.Copy(ioutil.Discard, r); err != context.DeadlineExceeded {
+        t.Errorf("Expected the deadline to stop reading, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("Cancelling took %v", elapsed)
+    }
+}
+
+func TestLimitReaderWithoutLimiters(t *testing.T) {
+    r := bytes.NewReader(nil)
+    if LimitReader(context.Background(), r) != io.Reader(r) {
+        t.Error("Reader without limiters was wrapped")
+    }
+    if LimitReader(context.Background(), r, nil, nil) != io.Reader(r) {
+        t.Error("Reader with only nil limiters was wrapped")
+    }
+}
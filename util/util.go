@@ -5,6 +5,7 @@ import (
     "fmt"
     "os"
     "regexp"
+    "strconv"
     "strings"
     "sync"
     "time"
@@ -19,6 +20,44 @@ func FileNotEmpty(path string) bool {
     return false
 }
 
+var sizeUnits = []string { "K", "M", "G", "T" }
+
+// Parses sizes such as 512K, 20M or 1.5G, with units being powers of 1024.
+// A trailing B or iB is accepted, and plain numbers are bytes.
+func ParseByteSize(s string) (int64, error) {
+    num := strings.ToUpper(strings.TrimSpace(s))
+    num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+    mult := int64(1)
+    for i, unit := range sizeUnits {
+        if strings.HasSuffix(num, unit) {
+            num = strings.TrimSuffix(num, unit)
+            mult = int64(1) << (10 * (i + 1))
+            break
+        }
+    }
+    v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+    if err != nil || v < 0 {
+        return 0, fmt.Errorf("Invalid size '%s'", s)
+    }
+    return int64(v * float64(mult)), nil
+}
+
+// Formats a size in bytes with 1024 based units, such as 1.5MiB.
+func FormatByteSize(size float64) string {
+    if size < 1024 {
+        return fmt.Sprintf("%.0fB", size)
+    }
+    unit := ""
+    for _, u := range sizeUnits {
+        if size < 1024 {
+            break
+        }
+        size /= 1024
+        unit = u
+    }
+    return fmt.Sprintf("%.1f%siB", size, unit)
+}
+
 var bestVideoFormats = []int{
     337, 315, 266, 138, // 2160p60
     313, 336, // 2160p
@@ -86,11 +125,11 @@ type FregJson struct {
     formatLock sync.Mutex
 }
 
-func pickBestID(urls map[int]string, order []int, guess bool) int {
+func pickBestID(urls map[int]string, order []int, guess bool) (int, error) {
     for _, v := range order {
         _, ok := urls[v]
         if ok {
-            return v
+            return v, nil
         }
     }
     //no format is known, pick whatever is highest to maybe get the best quality
@@ -103,44 +142,45 @@ func pickBestID(urls map[int]string, order []int, guess bool) int {
             }
         }
         if _, ok := urls[max]; ok {
-            return max
+            return max, nil
         }
-        log.Fatalf("Unable to find a suitable codec (tried %v, picking highest)", order)
-    } else {
-        log.Fatalf("Unable to find a suitable codec (tried %v)", order)
+        return -1, fmt.Errorf("Unable to find a suitable codec (tried %v, picking highest)", order)
     }
-    return -1
+    return -1, fmt.Errorf("Unable to find a suitable codec (tried %v)", order)
 }
 
-func pickBest(urls map[int]string, preferredFormats []int, order []int, names map[int]string, which string) string {
+func pickBest(urls map[int]string, preferredFormats []int, order []int, names map[int]string, which string) (string, error) {
     guess := true
     if preferredFormats != nil {
         order = preferredFormats
         guess = false
     }
 
-    id := pickBestID(urls, order, guess)
+    id, err := pickBestID(urls, order, guess)
+    if err != nil {
+        return "", err
+    }
     name, ok := names[id]
     if !ok {
         name = "unknown codec"
     }
     log.Infof("Using format %d (%s) for %s", id, name, which)
-    return urls[id]
+    return urls[id], nil
 }
 
-func (f *FregJson) BestVideo(preferredFormats []int) string {
+func (f *FregJson) BestVideo(preferredFormats []int) (string, error) {
     return pickBest(f.Video, preferredFormats, bestVideoFormats, videoFormatNames, "video")
 }
 
-func (f *FregJson) BestAudio(preferredFormats []int) string {
+func (f *FregJson) BestAudio(preferredFormats []int) (string, error) {
     return pickBest(f.Audio, preferredFormats, bestAudioFormats, audioFormatNames, "audio")
 }
 
-func (f *FregJson) fillFormatVals() {
+func (f *FregJson) fillFormatVals() error {
     f.formatLock.Lock()
     defer f.formatLock.Unlock()
     if len(f.formatVals) > 0 {
-        return
+        return nil
     }
     vals := make(map[string]string)
     vals["id"] = f.Metadata.Id
@@ -156,16 +196,19 @@ func (f *FregJson) fillFormatVals() {
     channelUrlRegex := regexp.MustCompile(`^https?://(?:www\.)youtube.com/channel/([a-zA-Z0-9\-_]+)$`)
     channelIdMatch := channelUrlRegex.FindStringSubmatch(f.Metadata.ChannelURL)
     if len(channelIdMatch) < 2 {
-        log.Fatalf("Unable to parse channel url '%s'", f.Metadata.ChannelURL)
+        return fmt.Errorf("Unable to parse channel url '%s'", f.Metadata.ChannelURL)
     }
     vals["channel_url"] = f.Metadata.ChannelURL
     vals["channel_id"] = channelIdMatch[1]
 
     f.formatVals = vals
+    return nil
 }
 
 func (f *FregJson) FormatTemplate(template string, filename bool) (string, error) {
-    f.fillFormatVals()
+    if err := f.fillFormatVals(); err != nil {
+        return "", err
+    }
     pythonMapKey := regexp.MustCompile(`%\((\w+)\)s`)
     for {
         match := pythonMapKey.FindStringSubmatch(template)
@@ -191,13 +234,17 @@ func (f *FregJson) FormatTemplate(template string, filename bool) (string, error
     }
 }
 
-func (f *FregJson) WriteThumbnail(path string) error {
+func (f *FregJson) ThumbnailData() ([]byte, error) {
     b64 := f.Metadata.Thumbnail
     if idx := strings.IndexByte(b64, ','); idx >= 0 {
         b64 = b64[idx + 1:]
     }
 
-    dec, err := base64.StdEncoding.DecodeString(b64)
+    return base64.StdEncoding.DecodeString(b64)
+}
+
+func (f *FregJson) WriteThumbnail(path string) error {
+    dec, err := f.ThumbnailData()
     if err != nil {
         return err
     }